@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
@@ -12,8 +13,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func main() {
@@ -22,49 +25,111 @@ func main() {
 		log.Fatalf("Error loading configuration: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(cfg)
+		return
+	}
+
 	var storage limiter.StorageStrategy
 	switch cfg.StorageBackend {
+	case "memory":
+		storage, err = limiter.NewMemoryStorage(cfg.MemoryMaxKeys, cfg.MemoryCleanupInterval)
 	case "redis":
-		storage, err = limiter.NewRedisStorage(cfg.RedisURL)
-	case "memcached":
-		server := strings.Split(cfg.MemcachedServer, ",")
-		for i := range server {
-			server[i] = strings.TrimSpace(server[i])
+		switch cfg.RedisMode {
+		case "sentinel":
+			storage, err = limiter.NewRedisSentinelStorage(cfg.RedisMasterName, splitAddrs(cfg.RedisAddrs), cfg.RedisPassword, cfg.RedisDB)
+		case "cluster":
+			storage, err = limiter.NewRedisClusterStorage(splitAddrs(cfg.RedisAddrs), cfg.RedisPassword)
+		default:
+			storage, err = limiter.NewRedisStorage(cfg.RedisURL)
 		}
-		storage, err = limiter.NewMemcachedStorage(server)
+	case "memcached":
+		storage, err = limiter.NewMemcachedStorage(splitAddrs(cfg.MemcachedServer))
 	case "mysql":
-		storage, err = limiter.NewMySQLStorage(cfg.MySQLDSN)
+		storage, err = limiter.NewMySQLStorage(cfg.MySQLDSN, cfg.SQLAutoMigrate, cfg.SQLCleanupInterval, cfg.SQLCleanupBatchSize)
 	case "postgres":
-		storage, err = limiter.NewPostgresStorage(cfg.PostgresDSN)
+		storage, err = limiter.NewPostgresStorage(cfg.PostgresDSN, cfg.SQLAutoMigrate, cfg.SQLCleanupInterval, cfg.SQLCleanupBatchSize)
+	case "sqlite":
+		storage, err = limiter.NewSQLiteStorage(cfg.SQLitePath, cfg.SQLAutoMigrate, cfg.SQLCleanupInterval, cfg.SQLCleanupBatchSize)
 	default:
 		err = fmt.Errorf("unknown storage backend: %s", cfg.StorageBackend)
 	}
 	if err != nil {
 		log.Fatalf("failed initializing storage: %v", err)
 	}
+
+	// An in-process storage cannot fail, anything else may go away.
+	if cfg.StorageBackend != "memory" {
+		var fallback limiter.StorageStrategy
+		if cfg.FailurePolicy == limiter.FailurePolicyLocal {
+			fallback, err = limiter.NewMemoryStorage(cfg.MemoryMaxKeys, cfg.MemoryCleanupInterval)
+			if err != nil {
+				log.Fatalf("failed initializing fallback storage: %v", err)
+			}
+		}
+		storage = limiter.NewCircuitBreakerStorage(storage, fallback, cfg.BreakerThreshold, cfg.BreakerCooldown)
+
+		if cfg.LocalCache {
+			storage = limiter.NewTieredStorage(storage, cfg.LocalCacheSyncEvery, cfg.LocalCacheMaxUnsynced)
+		}
+	}
 	defer storage.Close()
 
 	rateLimiter := limiter.NewRateLimiter(cfg, storage)
 	defer rateLimiter.Close()
+	go watchConfig(rateLimiter, cfg)
 
 	if os.Getenv("GIN_MODE") == "" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	router := gin.Default()
+
+	// The admin API is only served when protected by a token. It is set up
+	// ahead of the rate limiter so that operators are not locked out by the
+	// limits they came to change.
+	if cfg.AdminToken != "" {
+		overrideHandler := handlers.NewOverrideHandler(rateLimiter)
+		admin := router.Group("/admin", middleware.AdminAuthMiddleware(cfg.AdminToken))
+		admin.GET("/overrides/:identity", overrideHandler.Get)
+		admin.PUT("/overrides/:identity", overrideHandler.Put)
+		admin.DELETE("/overrides/:identity", overrideHandler.Delete)
+	}
+
 	router.Use(middleware.RateLimitMiddleware(rateLimiter))
 
 	pingHandler := handlers.NewPingHandler()
+	quotaHandler := handlers.NewQuotaHandler(rateLimiter)
 
 	router.GET("/ping", pingHandler.Ping)
+	router.GET("/quota", quotaHandler.Quota)
 
 	fmt.Printf("Rate Limiter Service starting on port %s\n", cfg.ServerPort)
 	fmt.Printf("Configuration:\n")
-	fmt.Printf("   - IP Limit: %d requests/second\n", cfg.IPLimit)
-	fmt.Printf("   - Token Default Limit: %d requests/second\n", cfg.TokenLimitDefault)
+	fmt.Printf("   - IP Limit: %d requests per %v\n", cfg.IPLimit, cfg.IPWindow)
+	fmt.Printf("   - Token Default Limit: %d requests per %v\n", cfg.TokenLimitDefault, cfg.TokenWindowDefault)
+	fmt.Printf("   - Extra IP Limits: %d configured\n", len(cfg.IPExtraLimits))
 	fmt.Printf("   - Custom Token Limits: %d tokens configured\n", len(cfg.CustomTokenLimit))
+	fmt.Printf("   - Custom Token Quotas: %d tokens configured\n", len(cfg.CustomTokenQuota))
+	if cfg.Policy != nil {
+		fmt.Printf("   - Policy Rules: %d rules from %s\n", len(cfg.Policy.Rules), cfg.PolicyFile)
+		fmt.Printf("   - Token Tiers: %d tiers, %d tokens from %s\n", len(cfg.Policy.Tiers), len(cfg.Policy.TokenTiers), cfg.PolicyFile)
+	}
+	if cfg.TokenTierSource == "storage" {
+		fmt.Printf("   - Token Tier Lookup: token_tiers table, cached for %v\n", cfg.TokenTierCacheTTL)
+	}
+	fmt.Printf("   - Quota Time Zone: %s\n", cfg.QuotaTimezone)
 	fmt.Printf("   - Block Duration: %v\n", cfg.BlockDuration)
+	fmt.Printf("   - Algorithm: %s\n", cfg.Algorithm)
 	fmt.Printf("   - Storage Backend: %s\n", cfg.StorageBackend)
+	fmt.Printf("   - Failure Policy: %s\n", cfg.FailurePolicy)
+	fmt.Printf("   - Limit Overrides: cached for %v\n", cfg.OverrideCacheTTL)
+	if cfg.AdminToken != "" {
+		fmt.Printf("   - Admin API: enabled\n")
+	}
+	if cfg.LocalCache && cfg.StorageBackend != "memory" {
+		fmt.Printf("   - Local Cache: sync every %v or %d requests\n", cfg.LocalCacheSyncEvery, cfg.LocalCacheMaxUnsynced)
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -79,3 +144,163 @@ func main() {
 	fmt.Println("Shutting down server...")
 	fmt.Println("Server stopped gracefully")
 }
+
+// watchConfig reloads the configuration into rateLimiter on SIGHUP, and when
+// the policy file changes if PolicyWatchInterval is set. An invalid
+// configuration is logged and the running one kept.
+func watchConfig(rateLimiter *limiter.RateLimiter, cfg *config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if cfg.PolicyWatchInterval > 0 {
+		ticker := time.NewTicker(cfg.PolicyWatchInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	modTime := policyModTime(cfg.PolicyFile)
+	for {
+		select {
+		case <-hup:
+			log.Printf("[Config] SIGHUP received, reloading configuration")
+		case <-tick:
+			latest := policyModTime(cfg.PolicyFile)
+			if latest.Equal(modTime) {
+				continue
+			}
+			// Remembered even if the reload fails, so that a broken file is
+			// reported once rather than on every tick.
+			modTime = latest
+			log.Printf("[Config] Policy file %s changed, reloading configuration", cfg.PolicyFile)
+		}
+
+		reloaded, err := config.LoadConfig()
+		if err == nil {
+			err = checkReload(cfg, reloaded)
+		}
+		if err != nil {
+			log.Printf("[Config] Keeping current configuration: %v", err)
+			continue
+		}
+		keepStartupSettings(cfg, reloaded)
+		rateLimiter.Reload(reloaded)
+		cfg = reloaded
+		modTime = policyModTime(cfg.PolicyFile)
+		log.Printf("[Config] Configuration reloaded")
+	}
+}
+
+// checkReload rejects a reloaded configuration that needs a restart to take
+// effect. The fallback storage of the local failure policy is only created at
+// startup, so switching to or from it would quietly be ignored.
+func checkReload(current, reloaded *config.Config) error {
+	if (current.FailurePolicy == limiter.FailurePolicyLocal) != (reloaded.FailurePolicy == limiter.FailurePolicyLocal) {
+		return fmt.Errorf("switching RL_FAILURE_POLICY from %q to %q takes a restart", current.FailurePolicy, reloaded.FailurePolicy)
+	}
+	return nil
+}
+
+// startupSetting is a setting only read at startup: the variable setting it
+// and a pointer to its field in a configuration. The value of a secret one is
+// never logged.
+type startupSetting struct {
+	name   string
+	field  any
+	secret bool
+}
+
+func startupSettings(cfg *config.Config) []startupSetting {
+	return []startupSetting{
+		{"SERVER_PORT", &cfg.ServerPort, false},
+		{"STORAGE_BACKEND", &cfg.StorageBackend, false},
+		{"REDIS_URL", &cfg.RedisURL, true},
+		{"REDIS_MODE", &cfg.RedisMode, false},
+		{"REDIS_ADDRS", &cfg.RedisAddrs, false},
+		{"REDIS_SENTINEL_MASTER", &cfg.RedisMasterName, false},
+		{"REDIS_PASSWORD", &cfg.RedisPassword, true},
+		{"REDIS_DB", &cfg.RedisDB, false},
+		{"MEMCACHED_SERVER", &cfg.MemcachedServer, false},
+		{"MYSQL_DSN", &cfg.MySQLDSN, true},
+		{"POSTGRES_DSN", &cfg.PostgresDSN, true},
+		{"SQLITE_PATH", &cfg.SQLitePath, false},
+		{"SQL_AUTO_MIGRATE", &cfg.SQLAutoMigrate, false},
+		{"SQL_CLEANUP_INTERVAL_SECONDS", &cfg.SQLCleanupInterval, false},
+		{"SQL_CLEANUP_BATCH_SIZE", &cfg.SQLCleanupBatchSize, false},
+		{"MEMORY_MAX_KEYS", &cfg.MemoryMaxKeys, false},
+		{"MEMORY_CLEANUP_INTERVAL_SECONDS", &cfg.MemoryCleanupInterval, false},
+		{"LOCAL_CACHE_ENABLED", &cfg.LocalCache, false},
+		{"LOCAL_CACHE_SYNC_INTERVAL_MS", &cfg.LocalCacheSyncEvery, false},
+		{"LOCAL_CACHE_MAX_UNSYNCED", &cfg.LocalCacheMaxUnsynced, false},
+		{"RL_BREAKER_THRESHOLD", &cfg.BreakerThreshold, false},
+		{"RL_BREAKER_COOLDOWN_SECONDS", &cfg.BreakerCooldown, false},
+		{"RL_QUEUE_MAX_DELAY_MS", &cfg.QueueMaxDelay, false},
+		{"RL_ADMIN_TOKEN", &cfg.AdminToken, true},
+		{"RL_POLICY_WATCH_INTERVAL_SECONDS", &cfg.PolicyWatchInterval, false},
+	}
+}
+
+// keepStartupSettings puts back in reloaded the settings only read at
+// startup, logging those that were changed, so that the configuration kept
+// describes the running service.
+func keepStartupSettings(current, reloaded *config.Config) {
+	kept := startupSettings(current)
+	for i, setting := range startupSettings(reloaded) {
+		was := reflect.ValueOf(kept[i].field).Elem()
+		now := reflect.ValueOf(setting.field).Elem()
+		if now.Equal(was) {
+			continue
+		}
+		if setting.secret {
+			log.Printf("[Config] Ignoring the change of %s: it takes a restart", setting.name)
+		} else {
+			log.Printf("[Config] Ignoring the change of %s from %v to %v: it takes a restart", setting.name, was, now)
+		}
+		now.Set(was)
+	}
+}
+
+// policyModTime returns when the policy file was last modified, or the zero
+// time if there is none.
+func policyModTime(file string) time.Time {
+	if file == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// migrate brings the schema of the configured SQL backend up to date and exits.
+func migrate(cfg *config.Config) {
+	dsn := ""
+	switch cfg.StorageBackend {
+	case "mysql":
+		dsn = cfg.MySQLDSN
+	case "postgres":
+		dsn = cfg.PostgresDSN
+	case "sqlite":
+		dsn = cfg.SQLitePath
+	}
+
+	from, to, err := limiter.MigrateSQL(context.Background(), cfg.StorageBackend, dsn)
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+	if from == to {
+		fmt.Printf("Schema is up to date at version %d\n", to)
+		return
+	}
+	fmt.Printf("Schema migrated from version %d to %d\n", from, to)
+}
+
+// splitAddrs turns a comma-separated list of server addresses into a slice.
+func splitAddrs(value string) []string {
+	addrs := strings.Split(value, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	return addrs
+}
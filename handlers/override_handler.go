@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+	"net/http"
+	"time"
+)
+
+// OverrideHandler manages the limit overrides of single clients, named by
+// the :identity path parameter as "ip:<address>" or "token:<token>".
+type OverrideHandler struct {
+	rateLimiter *limiter.RateLimiter
+}
+
+func NewOverrideHandler(rateLimiter *limiter.RateLimiter) *OverrideHandler {
+	return &OverrideHandler{rateLimiter: rateLimiter}
+}
+
+// overrideRequest is the body of a PUT. The override lasts for TTL or until
+// ExpiresAt, whichever is given.
+type overrideRequest struct {
+	Limit     int       `json:"limit"`
+	Window    string    `json:"window"`
+	Burst     int       `json:"burst"`
+	TTL       string    `json:"ttl"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (oh *OverrideHandler) Get(c *gin.Context) {
+	override, err := oh.rateLimiter.Override(c.Request.Context(), c.Param("identity"))
+	if err != nil {
+		overrideError(c, err)
+		return
+	}
+	if override == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Not Found",
+			"message": "No override is set for this client",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, overrideJSON(c.Param("identity"), override))
+}
+
+func (oh *OverrideHandler) Put(c *gin.Context) {
+	var body overrideRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		badRequest(c, "Invalid JSON body: "+err.Error())
+		return
+	}
+
+	window, err := time.ParseDuration(body.Window)
+	if err != nil {
+		badRequest(c, "Invalid window, expected a duration such as 1s or 1m")
+		return
+	}
+	if window < time.Millisecond || window%time.Millisecond != 0 {
+		badRequest(c, "Invalid window, expected a whole number of milliseconds of at least 1ms")
+		return
+	}
+	expiresAt := body.ExpiresAt
+	switch {
+	case body.TTL != "" && !expiresAt.IsZero():
+		badRequest(c, "Give either ttl or expires_at, not both")
+		return
+	case body.TTL != "":
+		ttl, err := time.ParseDuration(body.TTL)
+		if err != nil {
+			badRequest(c, "Invalid ttl, expected a duration such as 30m or 24h")
+			return
+		}
+		expiresAt = time.Now().Add(ttl)
+	case expiresAt.IsZero():
+		badRequest(c, "An override needs a ttl or an expires_at")
+		return
+	}
+
+	override := limiter.Override{Limit: body.Limit, Window: window, Burst: body.Burst, ExpiresAt: expiresAt}
+	if err := oh.rateLimiter.SetOverride(c.Request.Context(), c.Param("identity"), override); err != nil {
+		overrideError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, overrideJSON(c.Param("identity"), &override))
+}
+
+func (oh *OverrideHandler) Delete(c *gin.Context) {
+	if err := oh.rateLimiter.DeleteOverride(c.Request.Context(), c.Param("identity")); err != nil {
+		overrideError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func overrideJSON(identity string, override *limiter.Override) gin.H {
+	return gin.H{
+		"identity":   identity,
+		"limit":      override.Limit,
+		"window":     override.Window.String(),
+		"burst":      override.Burst,
+		"expires_at": override.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+func overrideError(c *gin.Context, err error) {
+	if errors.Is(err, limiter.ErrInvalidIdentity) || errors.Is(err, limiter.ErrInvalidOverride) {
+		badRequest(c, err.Error())
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error":   err.Error(),
+		"message": "Internal Server Error",
+	})
+}
+
+func badRequest(c *gin.Context, message string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error":   "Bad Request",
+		"message": message,
+	})
+}
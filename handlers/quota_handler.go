@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/middleware"
+	"net/http"
+)
+
+type QuotaHandler struct {
+	rateLimiter *limiter.RateLimiter
+}
+
+func NewQuotaHandler(rateLimiter *limiter.RateLimiter) *QuotaHandler {
+	return &QuotaHandler{rateLimiter: rateLimiter}
+}
+
+func (qh *QuotaHandler) Quota(c *gin.Context) {
+	clientIP, apiToken := middleware.ClientIdentity(c)
+
+	status, err := qh.rateLimiter.Quota(c.Request.Context(), clientIP, apiToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   err.Error(),
+			"message": "Internal Server Error",
+		})
+		return
+	}
+	if status == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Not Found",
+			"message": "No quota is configured for this client",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"limit":     status.Limit,
+		"used":      status.Used,
+		"remaining": status.Remaining,
+		"period":    status.Period,
+		"reset":     status.ResetTime.Unix(),
+	})
+}
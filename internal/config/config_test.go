@@ -0,0 +1,36 @@
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+func TestLoadConfigWindows(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   string
+		value string
+		want  string
+	}{
+		{"IP window", "RL_IP_WINDOW", "500us", "invalid IP window: window must be a whole number of milliseconds, at least 1ms, got 500µs"},
+		{"token window", "RL_TOKEN_WINDOW_DEFAULT", "1500us", "invalid token window default: window must be a whole number of milliseconds, at least 1ms, got 1.5ms"},
+		{"custom token window", "RL_CUSTOM_TOKEN_LIMITS", "abc123:10/500us", "invalid limit for token 'abc123': window must be a whole number of milliseconds, at least 1ms, got 500µs"},
+		{"extra limit window", "RL_IP_EXTRA_LIMITS", "300/0s", "invalid RL_IP_EXTRA_LIMITS: window must be a whole number of milliseconds, at least 1ms, got 0s"},
+		{"whole milliseconds", "RL_IP_WINDOW", "250ms", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := config.LoadConfig()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("LoadConfig failed: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("LoadConfig error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is the content of the policy file: named rules applied to requests
+// in file order, the limits of each token tier, and the tier of each API
+// token.
+type Policy struct {
+	Rules      []Rule
+	Tiers      map[string]Tier
+	TokenTiers map[string]string
+}
+
+// Tier holds the limits shared by the tokens of a tier. Extra holds further
+// limits stacked on top of the primary one. A zero Burst defaults to Limit; a
+// zero Quota, Algorithm or BlockDuration means the usual token one.
+type Tier struct {
+	Limit         int
+	Window        time.Duration
+	Burst         int
+	Extra         []WindowLimit
+	Algorithm     string
+	Quota         Quota
+	BlockDuration time.Duration
+}
+
+// Rule is a limit applying to the requests its match selects. A zero Burst,
+// Algorithm or BlockDuration means the client's usual one.
+type Rule struct {
+	Name          string
+	Match         RuleMatch
+	Limit         int
+	Window        time.Duration
+	Burst         int
+	Algorithm     string
+	BlockDuration time.Duration
+}
+
+// RuleMatch selects requests by their attributes. Every condition set must
+// hold for a request to match; an empty match selects every request.
+//
+// Route is a gin route pattern such as "/users/:id", matching the requests
+// served by that route. Path is a path.Match pattern matched against the
+// request path, in which "*" stands for a single path segment. Headers must
+// have exactly the given values, or be present at all for "*".
+type RuleMatch struct {
+	Route      string
+	Path       string
+	Methods    []string
+	Headers    map[string]string
+	IPRanges   []*net.IPNet
+	TokenTiers []string
+}
+
+// LoadPolicy reads and validates a YAML or JSON policy file. Errors point at
+// the offending line.
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading policy file: %w", err)
+	}
+	return parsePolicy(file, data)
+}
+
+// yamlErrorLine picks the line number out of a yaml syntax error.
+var yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// ruleName is what rule names may consist of. They end up in storage keys, and
+// Memcached keys cannot hold spaces.
+var ruleName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// errUnknownField is returned for a field the policy file format does not have.
+var errUnknownField = errors.New("unknown field")
+
+// policyParser turns the nodes of a policy document into a Policy, naming the
+// file and line of the first problem found.
+type policyParser struct {
+	file string
+}
+
+func (p *policyParser) errorf(node *yaml.Node, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", p.file, node.Line, fmt.Sprintf(format, args...))
+}
+
+func parsePolicy(file string, data []byte) (*Policy, error) {
+	p := &policyParser{file: file}
+	policy := &Policy{Tiers: make(map[string]Tier), TokenTiers: make(map[string]string)}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+			return nil, fmt.Errorf("%s:%s: %s", file, m[1], strings.TrimPrefix(err.Error(), m[0]))
+		}
+		// yaml leaves the line out of errors on the first one.
+		return nil, fmt.Errorf("%s: %s", file, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	if len(doc.Content) == 0 {
+		return policy, nil
+	}
+
+	// Tokens may come before the tiers they refer to, so they are checked
+	// once the whole document has been read.
+	var tokenNodes []*yaml.Node
+	err := p.mapping(doc.Content[0], func(key string, value *yaml.Node) error {
+		switch key {
+		case "rules":
+			return p.rules(value, policy)
+		case "tiers":
+			return p.mapping(value, func(name string, node *yaml.Node) error {
+				if !ruleName.MatchString(name) {
+					return fmt.Errorf("invalid tier name %q (use letters, digits, '-', '_' and '.')", name)
+				}
+				tier, err := p.tier(name, node)
+				policy.Tiers[name] = tier
+				return err
+			})
+		case "tokens":
+			return p.maskedMapping(value, maskToken, func(token string, tier *yaml.Node) error {
+				name, err := p.str(tier)
+				if err != nil {
+					return p.errorf(tier, "tier of token %s: %v", maskToken(token), err)
+				}
+				if name == "" {
+					return p.errorf(tier, "empty tier for token %s", maskToken(token))
+				}
+				policy.TokenTiers[token] = name
+				tokenNodes = append(tokenNodes, tier)
+				return nil
+			})
+		}
+		return errUnknownField
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without tier definitions, tiers only serve to match rules on.
+	if len(policy.Tiers) > 0 {
+		for _, node := range tokenNodes {
+			if _, ok := policy.Tiers[node.Value]; !ok {
+				return nil, p.errorf(node, "unknown tier %q", node.Value)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (p *policyParser) tier(name string, node *yaml.Node) (Tier, error) {
+	var tier Tier
+	err := p.mapping(node, func(key string, value *yaml.Node) error {
+		var err error
+		switch key {
+		case "limit":
+			tier.Limit, err = p.positiveInt(value)
+		case "window":
+			tier.Window, err = p.window(value)
+		case "burst":
+			tier.Burst, err = p.positiveInt(value)
+		case "extra_limits":
+			tier.Extra, err = p.windowLimits(value)
+		case "algorithm":
+			tier.Algorithm, err = p.str(value)
+			if err == nil && !isKnownAlgorithm(tier.Algorithm) {
+				err = fmt.Errorf("unknown algorithm %q", tier.Algorithm)
+			}
+		case "quota":
+			var quota string
+			if quota, err = p.str(value); err == nil {
+				tier.Quota, err = parseQuota(quota)
+			}
+		case "ban_duration":
+			tier.BlockDuration, err = p.duration(value)
+		default:
+			err = errUnknownField
+		}
+		return err
+	})
+	if err != nil {
+		return Tier{}, err
+	}
+
+	switch {
+	case tier.Limit == 0:
+		return Tier{}, p.errorf(node, "tier %q has no limit", name)
+	case tier.Window == 0:
+		return Tier{}, p.errorf(node, "tier %q has no window", name)
+	}
+	return tier, nil
+}
+
+func (p *policyParser) rules(node *yaml.Node, policy *Policy) error {
+	if node.Kind != yaml.SequenceNode {
+		return p.errorf(node, "rules must be a list")
+	}
+
+	names := make(map[string]int)
+	for _, item := range node.Content {
+		rule, err := p.rule(item)
+		if err != nil {
+			return err
+		}
+		if line, ok := names[rule.Name]; ok {
+			return p.errorf(item, "rule %q already defined on line %d", rule.Name, line)
+		}
+		names[rule.Name] = item.Line
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return nil
+}
+
+func (p *policyParser) rule(node *yaml.Node) (Rule, error) {
+	var rule Rule
+	err := p.mapping(node, func(key string, value *yaml.Node) error {
+		var err error
+		switch key {
+		case "name":
+			rule.Name, err = p.str(value)
+			if err == nil && !ruleName.MatchString(rule.Name) {
+				err = fmt.Errorf("invalid name %q (use letters, digits, '-', '_' and '.')", rule.Name)
+			}
+		case "match":
+			rule.Match, err = p.match(value)
+		case "limit":
+			rule.Limit, err = p.positiveInt(value)
+		case "window":
+			rule.Window, err = p.window(value)
+		case "burst":
+			rule.Burst, err = p.positiveInt(value)
+		case "algorithm":
+			rule.Algorithm, err = p.str(value)
+			if err == nil && !isKnownAlgorithm(rule.Algorithm) {
+				err = fmt.Errorf("unknown algorithm %q", rule.Algorithm)
+			}
+		case "ban_duration":
+			rule.BlockDuration, err = p.duration(value)
+		default:
+			err = errUnknownField
+		}
+		return err
+	})
+	if err != nil {
+		return Rule{}, err
+	}
+
+	switch {
+	case rule.Name == "":
+		return Rule{}, p.errorf(node, "rule has no name")
+	case rule.Limit == 0:
+		return Rule{}, p.errorf(node, "rule %q has no limit", rule.Name)
+	case rule.Window == 0:
+		return Rule{}, p.errorf(node, "rule %q has no window", rule.Name)
+	}
+	return rule, nil
+}
+
+func (p *policyParser) match(node *yaml.Node) (RuleMatch, error) {
+	var match RuleMatch
+	err := p.mapping(node, func(key string, value *yaml.Node) error {
+		var err error
+		switch key {
+		case "route":
+			match.Route, err = p.str(value)
+			if err == nil && !strings.HasPrefix(match.Route, "/") {
+				err = fmt.Errorf("invalid route %q (expected a gin route pattern such as /users/:id)", match.Route)
+			}
+		case "path":
+			match.Path, err = p.str(value)
+			if err == nil {
+				if _, matchErr := path.Match(match.Path, ""); matchErr != nil {
+					err = fmt.Errorf("invalid pattern %q", match.Path)
+				}
+			}
+		case "methods":
+			match.Methods, err = p.strs(value)
+			for i, method := range match.Methods {
+				match.Methods[i] = strings.ToUpper(method)
+			}
+		case "headers":
+			match.Headers = make(map[string]string)
+			err = p.mapping(value, func(name string, headerValue *yaml.Node) error {
+				v, err := p.str(headerValue)
+				match.Headers[http.CanonicalHeaderKey(name)] = v
+				return err
+			})
+		case "ip_ranges":
+			match.IPRanges, err = p.ipRanges(value)
+		case "token_tiers":
+			match.TokenTiers, err = p.strs(value)
+		default:
+			err = errUnknownField
+		}
+		return err
+	})
+	return match, err
+}
+
+// mapping calls fn with each key and value of a mapping node. Errors returned
+// by fn without a position are reported at the key, naming it.
+func (p *policyParser) mapping(node *yaml.Node, fn func(key string, value *yaml.Node) error) error {
+	return p.maskedMapping(node, func(key string) string { return key }, fn)
+}
+
+// maskedMapping is mapping for keys that may only be named through mask.
+func (p *policyParser) maskedMapping(node *yaml.Node, mask func(key string) string, fn func(key string, value *yaml.Node) error) error {
+	if node.Kind != yaml.MappingNode {
+		return p.errorf(node, "expected a mapping")
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if seen[key.Value] {
+			return p.errorf(key, "duplicate field %q", mask(key.Value))
+		}
+		seen[key.Value] = true
+
+		err := fn(key.Value, value)
+		switch {
+		case err == nil:
+		case errors.Is(err, errUnknownField):
+			return p.errorf(key, "unknown field %q", mask(key.Value))
+		case !strings.HasPrefix(err.Error(), p.file+":"):
+			return p.errorf(key, "%s: %v", mask(key.Value), err)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *policyParser) str(node *yaml.Node) (string, error) {
+	if node.Kind != yaml.ScalarNode {
+		return "", errors.New("expected a string")
+	}
+	return strings.TrimSpace(node.Value), nil
+}
+
+func (p *policyParser) strs(node *yaml.Node) ([]string, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, errors.New("expected a list")
+	}
+
+	values := make([]string, 0, len(node.Content))
+	for _, item := range node.Content {
+		value, err := p.str(item)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (p *policyParser) positiveInt(node *yaml.Node) (int, error) {
+	value, err := strconv.Atoi(node.Value)
+	if node.Kind != yaml.ScalarNode || err != nil {
+		return 0, fmt.Errorf("invalid number %q", node.Value)
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("must be positive, got %d", value)
+	}
+	return value, nil
+}
+
+func (p *policyParser) duration(node *yaml.Node) (time.Duration, error) {
+	value, err := time.ParseDuration(node.Value)
+	if node.Kind != yaml.ScalarNode || err != nil {
+		return 0, fmt.Errorf("invalid duration %q (expected e.g. 1s, 5m)", node.Value)
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("must be positive, got %v", value)
+	}
+	return value, nil
+}
+
+// window parses the window of a rule or tier, see checkWindow.
+func (p *policyParser) window(node *yaml.Node) (time.Duration, error) {
+	window, err := p.duration(node)
+	if err != nil {
+		return 0, err
+	}
+	return window, checkWindow(window)
+}
+
+// windowLimits parses a list of "limit/window" values such as "300/1m".
+func (p *policyParser) windowLimits(node *yaml.Node) ([]WindowLimit, error) {
+	values, err := p.strs(node)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make([]WindowLimit, 0, len(values))
+	for i, value := range values {
+		limit, err := parseWindowLimits(value, ",")
+		if err != nil || len(limit) != 1 {
+			return nil, p.errorf(node.Content[i], "invalid limit %q (expected limit/window, e.g. 300/1m)", value)
+		}
+		limits = append(limits, limit[0])
+	}
+	return limits, nil
+}
+
+// ipRanges parses a list of CIDR ranges. A bare address stands for itself.
+func (p *policyParser) ipRanges(node *yaml.Node) ([]*net.IPNet, error) {
+	values, err := p.strs(node)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := make([]*net.IPNet, 0, len(values))
+	for i, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, p.errorf(node.Content[i], "invalid IP range %q", value)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// maskToken hides all but the ends of a token quoted in an error.
+func maskToken(token string) string {
+	if len(token) <= 4 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:2] + strings.Repeat("*", len(token)-4) + token[len(token)-2:]
+}
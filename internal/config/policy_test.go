@@ -0,0 +1,396 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+// writePolicy writes a policy file named name and returns its path.
+func writePolicy(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const yamlPolicy = `
+rules:
+  - name: login
+    match:
+      route: /login
+      methods: [post]
+      headers: {x-client: "*"}
+      ip_ranges: [10.0.0.0/8, 192.168.1.1]
+    limit: 5
+    window: 1m
+    burst: 10
+    algorithm: sliding_window
+    ban_duration: 10m
+  - name: free-reads
+    match: {path: /api/*, token_tiers: [free]}
+    limit: 100
+    window: 1s
+tokens:
+  abc123: free
+  xyz999: pro
+tiers:
+  free:
+    limit: 10
+    window: 1s
+    extra_limits: [300/1m]
+    quota: 10000/day
+    ban_duration: 5m
+  pro:
+    limit: 100
+    window: 1s
+    burst: 200
+    algorithm: token_bucket
+    quota: 1000000/month
+`
+
+const jsonPolicy = `{
+  "rules": [
+    {
+      "name": "login",
+      "match": {
+        "route": "/login",
+        "methods": ["post"],
+        "headers": {"x-client": "*"},
+        "ip_ranges": ["10.0.0.0/8", "192.168.1.1"]
+      },
+      "limit": 5,
+      "window": "1m",
+      "burst": 10,
+      "algorithm": "sliding_window",
+      "ban_duration": "10m"
+    },
+    {"name": "free-reads", "match": {"path": "/api/*", "token_tiers": ["free"]}, "limit": 100, "window": "1s"}
+  ],
+  "tokens": {"abc123": "free", "xyz999": "pro"},
+  "tiers": {
+    "free": {"limit": 10, "window": "1s", "extra_limits": ["300/1m"], "quota": "10000/day", "ban_duration": "5m"},
+    "pro": {"limit": 100, "window": "1s", "burst": 200, "algorithm": "token_bucket", "quota": "1000000/month"}
+  }
+}`
+
+func TestLoadPolicy(t *testing.T) {
+	want := &config.Policy{
+		Rules: []config.Rule{
+			{
+				Name: "login",
+				Match: config.RuleMatch{
+					Route:    "/login",
+					Methods:  []string{"POST"},
+					Headers:  map[string]string{"X-Client": "*"},
+					IPRanges: nil, // compared separately
+				},
+				Limit:         5,
+				Window:        time.Minute,
+				Burst:         10,
+				Algorithm:     "sliding_window",
+				BlockDuration: 10 * time.Minute,
+			},
+			{
+				Name:   "free-reads",
+				Match:  config.RuleMatch{Path: "/api/*", TokenTiers: []string{"free"}},
+				Limit:  100,
+				Window: time.Second,
+			},
+		},
+		Tiers: map[string]config.Tier{
+			"free": {
+				Limit:         10,
+				Window:        time.Second,
+				Extra:         []config.WindowLimit{{Limit: 300, Window: time.Minute}},
+				Quota:         config.Quota{Limit: 10000, Period: "day"},
+				BlockDuration: 5 * time.Minute,
+			},
+			"pro": {
+				Limit:     100,
+				Window:    time.Second,
+				Burst:     200,
+				Algorithm: "token_bucket",
+				Quota:     config.Quota{Limit: 1000000, Period: "month"},
+			},
+		},
+		TokenTiers: map[string]string{"abc123": "free", "xyz999": "pro"},
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"YAML", "policy.yaml", yamlPolicy},
+		{"JSON", "policy.json", jsonPolicy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := config.LoadPolicy(writePolicy(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatalf("LoadPolicy failed: %v", err)
+			}
+
+			var ranges []string
+			for _, ipRange := range policy.Rules[0].Match.IPRanges {
+				ranges = append(ranges, ipRange.String())
+			}
+			if want := []string{"10.0.0.0/8", "192.168.1.1/32"}; !reflect.DeepEqual(ranges, want) {
+				t.Errorf("IP ranges = %v, want %v", ranges, want)
+			}
+			policy.Rules[0].Match.IPRanges = nil
+
+			if !reflect.DeepEqual(policy, want) {
+				t.Errorf("LoadPolicy =\n%+v\nwant\n%+v", policy, want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicyTokensWithoutTiers(t *testing.T) {
+	// Without tier definitions, tiers only serve to match rules on, so tokens
+	// may name any tier.
+	policy, err := config.LoadPolicy(writePolicy(t, "policy.yaml", "tokens:\n  abc123: gold\n"))
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if tier := policy.TokenTiers["abc123"]; tier != "gold" {
+		t.Errorf("tier of abc123 = %q, want gold", tier)
+	}
+	if len(policy.Rules) != 0 || len(policy.Tiers) != 0 {
+		t.Errorf("LoadPolicy = %+v, want only token tiers", policy)
+	}
+}
+
+func TestLoadPolicyEmpty(t *testing.T) {
+	policy, err := config.LoadPolicy(writePolicy(t, "policy.yaml", ""))
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+	if len(policy.Rules) != 0 || len(policy.Tiers) != 0 || len(policy.TokenTiers) != 0 {
+		t.Errorf("LoadPolicy = %+v, want an empty policy", policy)
+	}
+}
+
+func TestLoadPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{
+			name:    "syntax error",
+			file:    "policy.yaml",
+			content: "rules: []\ntiers: free: {}\n",
+			want:    ":2: mapping values are not allowed in this context",
+		},
+		{
+			name:    "unknown top-level field",
+			file:    "policy.yaml",
+			content: "rules: []\nlimits: {}\n",
+			want:    `:2: unknown field "limits"`,
+		},
+		{
+			name:    "rules not a list",
+			file:    "policy.yaml",
+			content: "rules:\n  login: {}\n",
+			want:    ":2: rules must be a list",
+		},
+		{
+			name:    "unknown match field",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    match:\n      metods: [POST]\n    limit: 5\n    window: 1m\n",
+			want:    `:4: unknown field "metods"`,
+		},
+		{
+			name:    "duplicate field",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n    limit: 6\n    window: 1m\n",
+			want:    `:4: duplicate field "limit"`,
+		},
+		{
+			name:    "rule without name",
+			file:    "policy.yaml",
+			content: "rules:\n  - limit: 5\n    window: 1m\n",
+			want:    ":2: rule has no name",
+		},
+		{
+			name:    "rule without limit",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    window: 1m\n",
+			want:    `:2: rule "login" has no limit`,
+		},
+		{
+			name:    "rule without window",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n",
+			want:    `:2: rule "login" has no window`,
+		},
+		{
+			name:    "duplicate rule",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n    window: 1m\n  - name: login\n    limit: 6\n    window: 1m\n",
+			want:    `:5: rule "login" already defined on line 2`,
+		},
+		{
+			name:    "invalid rule name",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: log in\n    limit: 5\n    window: 1m\n",
+			want:    `:2: name: invalid name "log in" (use letters, digits, '-', '_' and '.')`,
+		},
+		{
+			name:    "negative limit",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: -5\n    window: 1m\n",
+			want:    ":3: limit: must be positive, got -5",
+		},
+		{
+			name:    "invalid limit",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: five\n    window: 1m\n",
+			want:    `:3: limit: invalid number "five"`,
+		},
+		{
+			name:    "invalid window",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n    window: 1x\n",
+			want:    `:4: window: invalid duration "1x" (expected e.g. 1s, 5m)`,
+		},
+		{
+			name:    "window finer than a millisecond",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n    window: 500us\n",
+			want:    ":4: window: window must be a whole number of milliseconds, at least 1ms, got 500µs",
+		},
+		{
+			name:    "window of fractional milliseconds",
+			file:    "policy.yaml",
+			content: "tiers:\n  free:\n    limit: 10\n    window: 1500us\n",
+			want:    ":4: window: window must be a whole number of milliseconds, at least 1ms, got 1.5ms",
+		},
+		{
+			name:    "unknown algorithm",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    limit: 5\n    window: 1m\n    algorithm: leaky\n",
+			want:    `:5: algorithm: unknown algorithm "leaky"`,
+		},
+		{
+			name:    "invalid route",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    match: {route: login}\n    limit: 5\n    window: 1m\n",
+			want:    `:3: route: invalid route "login" (expected a gin route pattern such as /users/:id)`,
+		},
+		{
+			name:    "invalid path pattern",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    match: {path: \"/login[\"}\n    limit: 5\n    window: 1m\n",
+			want:    `:3: path: invalid pattern "/login["`,
+		},
+		{
+			name:    "methods not a list",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    match:\n      methods: POST\n    limit: 5\n    window: 1m\n",
+			want:    ":4: methods: expected a list",
+		},
+		{
+			name:    "invalid IP range",
+			file:    "policy.yaml",
+			content: "rules:\n  - name: login\n    match:\n      ip_ranges:\n        - 10.0.0.0/8\n        - 10.0.0.0/33\n    limit: 5\n    window: 1m\n",
+			want:    `:6: invalid IP range "10.0.0.0/33"`,
+		},
+		{
+			name:    "tier without limit",
+			file:    "policy.yaml",
+			content: "tiers:\n  free:\n    window: 1s\n",
+			want:    `:3: tier "free" has no limit`,
+		},
+		{
+			name:    "tier without window",
+			file:    "policy.yaml",
+			content: "tiers:\n  free:\n    limit: 10\n",
+			want:    `:3: tier "free" has no window`,
+		},
+		{
+			name:    "invalid tier name",
+			file:    "policy.yaml",
+			content: "tiers:\n  free tier:\n    limit: 10\n    window: 1s\n",
+			want:    `:2: free tier: invalid tier name "free tier" (use letters, digits, '-', '_' and '.')`,
+		},
+		{
+			name:    "invalid extra limit",
+			file:    "policy.yaml",
+			content: "tiers:\n  free:\n    limit: 10\n    window: 1s\n    extra_limits:\n      - 300/1m\n      - 300\n",
+			want:    `:7: invalid limit "300" (expected limit/window, e.g. 300/1m)`,
+		},
+		{
+			name:    "invalid quota",
+			file:    "policy.yaml",
+			content: "tiers:\n  free:\n    limit: 10\n    window: 1s\n    quota: 100/week\n",
+			want:    ":5: quota: unknown quota period 'week' (expected day or month)",
+		},
+		{
+			name:    "token in an unknown tier",
+			file:    "policy.yaml",
+			content: "tokens:\n  abc123: free\n  xyz999: gold\ntiers:\n  free:\n    limit: 10\n    window: 1s\n",
+			want:    `:3: unknown tier "gold"`,
+		},
+		{
+			name:    "token without tier",
+			file:    "policy.yaml",
+			content: "tokens:\n  abc123: \"\"\n",
+			want:    ":2: empty tier for token ab**23",
+		},
+		{
+			name:    "token with a list of tiers",
+			file:    "policy.yaml",
+			content: "tokens:\n  abc123: [free]\n",
+			want:    ":2: tier of token ab**23: expected a string",
+		},
+		{
+			name:    "duplicate token",
+			file:    "policy.yaml",
+			content: "tokens:\n  abc123: free\n  abc123: pro\n",
+			want:    `:3: duplicate field "ab**23"`,
+		},
+		{
+			name:    "JSON syntax error",
+			file:    "policy.json",
+			content: "{\"rules\": [] \"tiers\": {}}\n",
+			want:    ": did not find expected ',' or '}'",
+		},
+		{
+			name:    "JSON unknown field",
+			file:    "policy.json",
+			content: "{\n  \"rules\": [\n    {\"name\": \"login\", \"limit\": 5, \"window\": \"1m\", \"metods\": [\"POST\"]}\n  ]\n}\n",
+			want:    `:3: unknown field "metods"`,
+		},
+		{
+			name:    "JSON invalid window",
+			file:    "policy.json",
+			content: "{\n  \"tiers\": {\n    \"free\": {\n      \"limit\": 10,\n      \"window\": 1\n    }\n  }\n}\n",
+			want:    `:5: window: invalid duration "1" (expected e.g. 1s, 5m)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writePolicy(t, tt.file, tt.content)
+			_, err := config.LoadPolicy(file)
+			if err == nil {
+				t.Fatalf("LoadPolicy succeeded, want error %q", file+tt.want)
+			}
+			if got := err.Error(); got != file+tt.want {
+				t.Errorf("LoadPolicy error = %q, want %q", got, file+tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmTokenBucket   = "token_bucket"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmGCRA          = "gcra"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
+
+// Limit describes how many requests an identity may send per window. Burst is
+// the bucket capacity used by the token bucket algorithm.
+type Limit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
+}
+
+// Decision is the outcome of applying an Algorithm to a single request.
+// Remaining is relative to Limit, the number of requests the algorithm lets
+// through back to back. An allowed request with a Delay has been queued and
+// must wait that long before it is processed.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration
+	Delay      time.Duration
+
+	// cancel gives a queued request's slot back when it stops waiting.
+	cancel func(ctx context.Context) error
+}
+
+// Algorithm decides whether a request for key fits into limit, recording it in
+// the underlying storage. A request counts as cost requests.
+type Algorithm interface {
+	Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error)
+}
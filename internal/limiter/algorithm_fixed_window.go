@@ -0,0 +1,45 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// FixedWindow counts requests in buckets aligned to the window length.
+type FixedWindow struct {
+	storage StorageStrategy
+}
+
+func NewFixedWindow(storage StorageStrategy) *FixedWindow {
+	return &FixedWindow{storage: storage}
+}
+
+func (f *FixedWindow) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	index, elapsed := windowIndex(time.Now(), limit.Window)
+	windowKey := fmt.Sprintf("%s:%d", key, index)
+
+	count, err := f.storage.IncrementBy(ctx, windowKey, cost, limit.Window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment rate counter: %w", err)
+	}
+
+	remaining := limit.Requests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return &Decision{
+		Allowed:    count <= limit.Requests,
+		Limit:      limit.Requests,
+		Remaining:  remaining,
+		ResetAfter: limit.Window - elapsed,
+	}, nil
+}
+
+// windowIndex numbers the windows of the given length since the Unix epoch and
+// returns the one containing now along with how far into it now is.
+func windowIndex(now time.Time, window time.Duration) (int64, time.Duration) {
+	nanos := now.UnixNano()
+	return nanos / int64(window), time.Duration(nanos % int64(window))
+}
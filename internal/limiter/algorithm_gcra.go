@@ -0,0 +1,85 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// gcraAttempts bounds how often GCRA retries its compare-and-set when other
+// requests for the same key keep winning the race.
+const gcraAttempts = 10
+
+// GCRA implements the generic cell rate algorithm. It only stores the
+// theoretical arrival time (TAT) of the next request per key and lets up to
+// limit.Burst requests arrive back to back.
+type GCRA struct {
+	storage StorageStrategy
+}
+
+func NewGCRA(storage StorageStrategy) *GCRA {
+	return &GCRA{storage: storage}
+}
+
+func (g *GCRA) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	tatKey := fmt.Sprintf("tat:%s", key)
+	interval := limit.Window / time.Duration(limit.Requests)
+	tolerance := interval * time.Duration(limit.Burst-1)
+
+	for attempt := 0; attempt < gcraAttempts; attempt++ {
+		stored, err := g.storage.GetTAT(ctx, tatKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read arrival time: %w", err)
+		}
+
+		now := time.Now()
+		tat := stored
+		if tat.Before(now) {
+			tat = now
+		}
+
+		allowAt := tat.Add(interval * time.Duration(cost-1)).Add(-tolerance)
+		if now.Before(allowAt) {
+			return &Decision{
+				Allowed:    false,
+				Limit:      limit.Burst,
+				Remaining:  0,
+				ResetAfter: allowAt.Sub(now),
+			}, nil
+		}
+
+		next := tat.Add(interval * time.Duration(cost))
+		swapped, err := g.storage.CompareAndSetTAT(ctx, tatKey, stored, next, next.Sub(now))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store arrival time: %w", err)
+		}
+		if !swapped {
+			continue
+		}
+
+		return &Decision{
+			Allowed:    true,
+			Limit:      limit.Burst,
+			Remaining:  int((tolerance + interval - next.Sub(now)) / interval),
+			ResetAfter: next.Sub(now),
+		}, nil
+	}
+	return nil, fmt.Errorf("failed to store arrival time: too many concurrent updates of %s", tatKey)
+}
+
+// tatNanos encodes a theoretical arrival time for storage, mapping the zero
+// time that stands for "no TAT yet" to 0.
+func tatNanos(tat time.Time) int64 {
+	if tat.IsZero() {
+		return 0
+	}
+	return tat.UnixNano()
+}
+
+// tatFromNanos is the inverse of tatNanos.
+func tatFromNanos(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// LeakyBucket lets up to limit.Burst requests through immediately and queues
+// the excess, releasing it at limit.Requests per window. Only requests that
+// would have to wait longer than maxDelay are rejected. Queue positions are
+// handed out through the same theoretical arrival time GCRA uses, so the queue
+// is shared by every instance talking to the storage.
+type LeakyBucket struct {
+	storage  StorageStrategy
+	maxDelay time.Duration
+}
+
+func NewLeakyBucket(storage StorageStrategy, maxDelay time.Duration) *LeakyBucket {
+	return &LeakyBucket{storage: storage, maxDelay: maxDelay}
+}
+
+func (l *LeakyBucket) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	tatKey := fmt.Sprintf("queue:%s", key)
+	interval := limit.Window / time.Duration(limit.Requests)
+	tolerance := interval * time.Duration(limit.Burst-1)
+
+	for attempt := 0; attempt < gcraAttempts; attempt++ {
+		stored, err := l.storage.GetTAT(ctx, tatKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read queue position: %w", err)
+		}
+
+		now := time.Now()
+		tat := stored
+		if tat.Before(now) {
+			tat = now
+		}
+
+		delay := tat.Add(interval * time.Duration(cost-1)).Add(-tolerance).Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		if delay > l.maxDelay {
+			return &Decision{
+				Allowed:    false,
+				Limit:      limit.Burst,
+				Remaining:  0,
+				ResetAfter: delay - l.maxDelay,
+			}, nil
+		}
+
+		next := tat.Add(interval * time.Duration(cost))
+		swapped, err := l.storage.CompareAndSetTAT(ctx, tatKey, stored, next, next.Sub(now))
+		if err != nil {
+			return nil, fmt.Errorf("failed to store queue position: %w", err)
+		}
+		if !swapped {
+			continue
+		}
+
+		remaining := int((tolerance + interval - next.Sub(now)) / interval)
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		return &Decision{
+			Allowed:    true,
+			Limit:      limit.Burst,
+			Remaining:  remaining,
+			ResetAfter: next.Sub(now),
+			Delay:      delay,
+			cancel: func(ctx context.Context) error {
+				// Giving the slot back only works while nobody queued up
+				// behind it; otherwise the later requests keep their turn.
+				// A position in the past still needs a positive TTL, or the
+				// storages would drop it or store it expired.
+				_, err := l.storage.CompareAndSetTAT(ctx, tatKey, next, stored, max(time.Until(stored), time.Millisecond))
+				return err
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("failed to store queue position: too many concurrent updates of %s", tatKey)
+}
@@ -0,0 +1,61 @@
+package limiter_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// TestLeakyBucketCancelledSlot checks that a request leaving the queue gives
+// its slot to the next one, including once the slot it restores has passed.
+func TestLeakyBucketCancelledSlot(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		newStorage func(t *testing.T) limiter.StorageStrategy
+	}{
+		{"Memory", newMemoryStorage},
+		{"SQLite", func(t *testing.T) limiter.StorageStrategy { return newSQLiteStorage(t) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.IPLimit, cfg.IPWindow, cfg.IPBurst = 5, time.Second, 1
+			cfg.IPAlgorithm = limiter.AlgorithmLeakyBucket
+			cfg.QueueMaxDelay = time.Second
+			rl := newTestLimiter(t, cfg, tt.newStorage(t))
+			req := limiter.Request{IP: "10.0.0.1", Method: http.MethodGet, Path: "/ping", Header: http.Header{}}
+
+			check := func() *limiter.Result {
+				t.Helper()
+				result, err := rl.Check(context.Background(), req, 1)
+				if err != nil {
+					t.Fatalf("Check failed: %v", err)
+				}
+				if !result.Allowed {
+					t.Fatalf("Check rejected the request: %s", result.Reason)
+				}
+				return result
+			}
+
+			check()
+			queued := check()
+			if queued.Delay < 150*time.Millisecond {
+				t.Fatalf("second request delay = %v, want about 200ms", queued.Delay)
+			}
+
+			// The client gives up once its slot has come and gone.
+			ctx, cancel := context.WithTimeout(context.Background(), queued.Delay/2)
+			defer cancel()
+			time.Sleep(queued.Delay)
+			if err := rl.Wait(ctx, queued); err == nil {
+				t.Fatal("Wait succeeded with a cancelled context")
+			}
+
+			if next := check(); next.Delay > 50*time.Millisecond {
+				t.Errorf("request after the cancelled one delay = %v, want none", next.Delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// SlidingLog keeps the timestamp of every accepted request and counts those
+// within the trailing window, trading storage for exact enforcement.
+type SlidingLog struct {
+	storage StorageStrategy
+}
+
+func NewSlidingLog(storage StorageStrategy) *SlidingLog {
+	return &SlidingLog{storage: storage}
+}
+
+func (s *SlidingLog) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	logKey := fmt.Sprintf("log:%s", key)
+
+	allowed, count, oldest, err := s.storage.LogRequest(ctx, logKey, cost, limit.Requests, limit.Window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to log request: %w", err)
+	}
+
+	remaining := limit.Requests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	// A slot frees up as soon as the oldest logged request leaves the window.
+	resetAfter := time.Until(oldest.Add(limit.Window))
+	if resetAfter < 0 {
+		resetAfter = 0
+	}
+
+	return &Decision{
+		Allowed:    allowed,
+		Limit:      limit.Requests,
+		Remaining:  remaining,
+		ResetAfter: resetAfter,
+	}, nil
+}
+
+// trimLog drops timestamps that fall out of the window ending at now and
+// appends now n times if that stays within limit. Backends without sorted
+// sets use it inside their own atomic read-modify-write.
+func trimLog(entries []time.Time, now time.Time, n, limit int, window time.Duration) (bool, []time.Time) {
+	cutoff := now.Add(-window)
+	kept := entries[:0]
+	for _, ts := range entries {
+		if ts.After(cutoff) {
+			kept = append(kept, ts)
+		}
+	}
+	if len(kept)+n > limit {
+		return false, kept
+	}
+	for i := 0; i < n; i++ {
+		kept = append(kept, now)
+	}
+	return true, kept
+}
@@ -0,0 +1,77 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// SlidingWindow approximates a rolling window by weighting the previous fixed
+// window's count by how much of it still overlaps the trailing window.
+type SlidingWindow struct {
+	storage StorageStrategy
+}
+
+func NewSlidingWindow(storage StorageStrategy) *SlidingWindow {
+	return &SlidingWindow{storage: storage}
+}
+
+func (s *SlidingWindow) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	index, elapsed := windowIndex(time.Now(), limit.Window)
+
+	// Counters have to outlive their own window so they can still be read as
+	// the previous one.
+	count, err := s.storage.IncrementBy(ctx, fmt.Sprintf("%s:%d", key, index), cost, 2*limit.Window)
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment rate counter: %w", err)
+	}
+	previous, err := s.storage.GetCount(ctx, fmt.Sprintf("%s:%d", key, index-1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous rate counter: %w", err)
+	}
+
+	weight := 1 - float64(elapsed)/float64(limit.Window)
+	estimated := float64(previous)*weight + float64(count)
+
+	remaining := int(math.Floor(float64(limit.Requests) - estimated))
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return &Decision{
+		Allowed:    estimated <= float64(limit.Requests),
+		Limit:      limit.Requests,
+		Remaining:  remaining,
+		ResetAfter: slidingWindowReset(limit, previous, count, elapsed),
+	}, nil
+}
+
+// slidingWindowReset returns how long until the estimate leaves room for
+// another request, or until the previous window stops counting altogether when
+// there is room already.
+func slidingWindowReset(limit Limit, previous, count int, elapsed time.Duration) time.Duration {
+	untilNext := limit.Window - elapsed
+	room := float64(limit.Requests - 1 - count)
+	if float64(previous)*(1-float64(elapsed)/float64(limit.Window)) <= room {
+		return untilNext
+	}
+
+	// Still inside the current window once the previous one has decayed enough.
+	if room >= 0 && previous > 0 {
+		at := time.Duration((1 - room/float64(previous)) * float64(limit.Window))
+		if at < limit.Window {
+			return at - elapsed
+		}
+	}
+
+	// Otherwise the current count becomes the previous one and has to decay.
+	if count == 0 {
+		return untilNext
+	}
+	at := time.Duration((1 - float64(limit.Requests-1)/float64(count)) * float64(limit.Window))
+	if at < 0 {
+		at = 0
+	}
+	return untilNext + at
+}
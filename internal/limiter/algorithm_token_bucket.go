@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// TokenBucket refills a bucket of limit.Burst tokens at limit.Requests tokens
+// per window and lets a request through while the bucket holds enough tokens
+// to pay for its cost.
+type TokenBucket struct {
+	storage StorageStrategy
+}
+
+func NewTokenBucket(storage StorageStrategy) *TokenBucket {
+	return &TokenBucket{storage: storage}
+}
+
+func (t *TokenBucket) Allow(ctx context.Context, key string, limit Limit, cost int) (*Decision, error) {
+	bucketKey := fmt.Sprintf("bucket:%s", key)
+	refillRate := float64(limit.Requests) / limit.Window.Seconds()
+
+	allowed, tokens, err := t.storage.TakeTokens(ctx, bucketKey, cost, limit.Burst, refillRate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take token: %w", err)
+	}
+
+	// An allowed request resets once the bucket is full again, a rejected one
+	// as soon as enough tokens for it have dripped in.
+	missing := float64(limit.Burst) - tokens
+	if !allowed {
+		missing = float64(cost) - tokens
+	}
+
+	return &Decision{
+		Allowed:    allowed,
+		Limit:      limit.Burst,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: time.Duration(missing / refillRate * float64(time.Second)),
+	}, nil
+}
+
+// bucketTTL is how long an idle bucket needs to refill completely, after which
+// its stored state is equivalent to a missing one.
+func bucketTTL(capacity int, refillRate float64) time.Duration {
+	return time.Duration(float64(capacity)/refillRate*float64(time.Second)) + time.Second
+}
+
+// takeFromBucket refills a bucket last updated at updatedAt and takes n
+// tokens from it if possible. Backends without server-side scripting use it
+// inside their own atomic read-modify-write.
+func takeFromBucket(tokens float64, updatedAt, now time.Time, n, capacity int, refillRate float64) (bool, float64) {
+	elapsed := now.Sub(updatedAt).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(float64(capacity), tokens+elapsed*refillRate)
+	}
+	if tokens < float64(n) {
+		return false, tokens
+	}
+	return true, tokens - float64(n)
+}
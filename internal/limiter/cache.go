@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCachedEntries bounds the number of entries a localCache holds, so that
+// clients making up tokens or addresses cannot grow it without limit.
+const maxCachedEntries = 100000
+
+type localCacheEntry[V any] struct {
+	value     V
+	expiresAt time.Time
+}
+
+// localCache remembers values looked up in the storage for a while, including
+// the absence of one, sparing a round trip per request for data that rarely
+// changes.
+type localCache[V any] struct {
+	mu      sync.Mutex
+	entries map[string]localCacheEntry[V]
+}
+
+func (c *localCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !entry.expiresAt.After(time.Now()) {
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+// put caches value under key for ttl. A ttl of zero caches nothing.
+func (c *localCache[V]) put(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[string]localCacheEntry[V])
+	}
+	if len(c.entries) >= maxCachedEntries {
+		for k, entry := range c.entries {
+			if !entry.expiresAt.After(now) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxCachedEntries {
+			clear(c.entries)
+		}
+	}
+	c.entries[key] = localCacheEntry[V]{value: value, expiresAt: now.Add(ttl)}
+}
+
+func (c *localCache[V]) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
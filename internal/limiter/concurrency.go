@@ -0,0 +1,109 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+// Lease holds one of an identity's concurrent request slots. It is renewed in
+// the background until Release is called, so a slot only outlives its request
+// by the lease TTL when the replica holding it dies.
+type Lease struct {
+	storage StorageStrategy
+	key     string
+	id      string
+	limit   int
+	ttl     time.Duration
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// acquire takes a concurrent request slot for ident. It returns a nil lease if
+// no concurrency limit applies, and false if all slots are taken.
+func (rl *RateLimiter) acquire(ctx context.Context, cfg *config.Config, ident identity) (*Lease, bool, error) {
+	if ident.concurrency <= 0 {
+		return nil, true, nil
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, false, err
+	}
+
+	lease := &Lease{
+		storage: rl.storage,
+		key:     fmt.Sprintf("conc:%s", ident.key),
+		id:      id,
+		limit:   ident.concurrency,
+		ttl:     cfg.ConcurrencyLeaseTTL,
+		stop:    make(chan struct{}),
+	}
+
+	acquired, _, err := rl.storage.AcquireLease(ctx, lease.key, lease.id, lease.limit, lease.ttl)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire concurrency slot: %w", err)
+	}
+	if !acquired {
+		return nil, false, nil
+	}
+
+	go lease.renew(context.WithoutCancel(ctx))
+	return lease, true, nil
+}
+
+func concurrencyExceeded(ident identity) *Result {
+	return &Result{
+		Allowed:             false,
+		Reason:              "Too many requests from this client are being processed at the same time",
+		ResetTime:           time.Now().Add(time.Second),
+		Limit:               ident.limits[0].Requests,
+		Remaining:           0,
+		ConcurrencyExceeded: true,
+	}
+}
+
+// Release gives the slot back. It is safe to call on a nil lease and more than
+// once.
+func (l *Lease) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		err = l.storage.ReleaseLease(ctx, l.key, l.id)
+	})
+	return err
+}
+
+func (l *Lease) renew(ctx context.Context) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if _, _, err := l.storage.AcquireLease(ctx, l.key, l.id, l.limit, l.ttl); err != nil {
+				fmt.Printf("failed to renew concurrency slot: %s: %v\n", l.key, err)
+			}
+		}
+	}
+}
+
+func newLeaseID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lease id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,68 @@
+package limiter_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// TestConcurrencyLimitRejectsBeforeCounting checks that a request turned away
+// because all of its client's slots are taken uses up none of its rate limit.
+func TestConcurrencyLimitRejectsBeforeCounting(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig()
+	cfg.IPConcurrencyLimit = 1
+	rl := newTestLimiter(t, cfg, newMemoryStorage(t))
+	req := limiter.Request{IP: "10.0.0.1", Method: http.MethodGet, Path: "/ping", Header: http.Header{}}
+
+	first, err := rl.Check(ctx, req, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !first.Allowed || first.Lease == nil {
+		t.Fatalf("first request allowed = %v, lease = %v, want allowed with a lease", first.Allowed, first.Lease)
+	}
+
+	for i := 0; i < 3; i++ {
+		result, err := rl.Check(ctx, req, 1)
+		if err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+		if result.Allowed || !result.ConcurrencyExceeded || result.Lease != nil {
+			t.Fatalf("request with all slots taken: allowed = %v, concurrency exceeded = %v, lease = %v", result.Allowed, result.ConcurrencyExceeded, result.Lease)
+		}
+	}
+
+	if err := first.Lease.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	second, err := rl.Check(ctx, req, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !second.Allowed || second.Remaining != 0 {
+		t.Fatalf("second request allowed = %v, remaining = %d, want allowed with 0 remaining", second.Allowed, second.Remaining)
+	}
+	if err := second.Lease.Release(ctx); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+
+	// The rate limit rejects the third request and gives its slot back.
+	third, err := rl.Check(ctx, req, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if third.Allowed || third.ConcurrencyExceeded || third.Lease != nil {
+		t.Fatalf("third request: allowed = %v, concurrency exceeded = %v, lease = %v, want rate limited", third.Allowed, third.ConcurrencyExceeded, third.Lease)
+	}
+	fourth, err := rl.Check(ctx, req, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if fourth.ConcurrencyExceeded {
+		t.Fatal("slot of the rate limited request is still held")
+	}
+}
@@ -0,0 +1,143 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// WindowChecker is implemented by storages able to run the whole fixed window
+// decision (ban check, counter increments and ban) in a single round trip,
+// atomically with respect to other requests for the same client.
+type WindowChecker interface {
+	// CheckWindows returns the remaining ban time straight away if banKey is
+	// banned. Otherwise it adds cost to the counter of each window in turn and
+	// stops at the first one going over its limit, banning banKey for the
+	// larger of blockDuration and that window's ResetAfter.
+	CheckWindows(ctx context.Context, banKey string, windows []WindowCheck, cost int, blockDuration time.Duration) (*WindowCheckResult, error)
+}
+
+// WindowCheck is a fixed window counter to increment, along with the limit it
+// is held to and the time left until it resets.
+type WindowCheck struct {
+	Key        string
+	Limit      int
+	Window     time.Duration
+	ResetAfter time.Duration
+}
+
+// WindowCheckResult is the outcome of CheckWindows. Counts holds the counter
+// values of the windows incremented, the last of which is over its limit if
+// Denied is set. BanTTL is how long the client remains banned.
+type WindowCheckResult struct {
+	Banned bool
+	Denied bool
+	Counts []int
+	BanTTL time.Duration
+}
+
+// checkWindows is the single round trip equivalent of Check for fixed window
+// identities without a quota.
+func (rl *RateLimiter) checkWindows(ctx context.Context, checker WindowChecker, ident identity, banKey string, cost int) (*Result, error) {
+	now := time.Now()
+	windows := make([]WindowCheck, len(ident.limits))
+	for i, limit := range ident.limits {
+		index, elapsed := windowIndex(now, limit.Window)
+		windows[i] = WindowCheck{
+			Key:        fmt.Sprintf("%s:%d", limitKey(ident.counterKey, i, limit), index),
+			Limit:      limit.Requests,
+			Window:     limit.Window,
+			ResetAfter: limit.Window - elapsed,
+		}
+	}
+
+	res, err := checker.CheckWindows(ctx, banKey, windows, cost, ident.blockDuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check rate limit: %w", err)
+	}
+
+	if res.Banned {
+		return &Result{
+			Allowed:   false,
+			Reason:    fmt.Sprintf("You have reached the maximum number of requests or actions allowed within a certain time frame"),
+			ResetTime: time.Now().Add(res.BanTTL),
+			Limit:     ident.limits[0].Requests,
+			Remaining: 0,
+		}, nil
+	}
+
+	if res.Denied {
+		return &Result{
+			Allowed:   false,
+			Reason:    fmt.Sprintf("You have reached the maximum number of requests or actions allowed within a certain time frame"),
+			ResetTime: time.Now().Add(res.BanTTL),
+			Limit:     windows[len(res.Counts)-1].Limit,
+			Remaining: 0,
+		}, nil
+	}
+
+	// Report the most restrictive window, as evaluate does.
+	tightest := 0
+	remaining := make([]int, len(windows))
+	for i, w := range windows {
+		remaining[i] = w.Limit - res.Counts[i]
+		if remaining[i] < 0 {
+			remaining[i] = 0
+		}
+		if remaining[i] < remaining[tightest] ||
+			(remaining[i] == remaining[tightest] && w.ResetAfter > windows[tightest].ResetAfter) {
+			tightest = i
+		}
+	}
+	w := windows[tightest]
+
+	return &Result{
+		Allowed:   true,
+		Reason:    fmt.Sprintf("Request allowed for %s (%d/%d requests)", ident.id, w.Limit-remaining[tightest], w.Limit),
+		ResetTime: time.Now().Add(w.ResetAfter),
+		Limit:     w.Limit,
+		Remaining: remaining[tightest],
+	}, nil
+}
+
+// checkWindowsWith makes the decision of WindowChecker.CheckWindows through
+// the plain operations of a storage, in several round trips.
+func checkWindowsWith(ctx context.Context, storage StorageStrategy, banKey string, windows []WindowCheck, cost int, blockDuration time.Duration) (*WindowCheckResult, error) {
+	banned, err := storage.IsBanned(ctx, banKey)
+	if err != nil {
+		return nil, err
+	}
+	if banned {
+		ttl, err := storage.GetBanReset(ctx, banKey)
+		if err != nil {
+			ttl = blockDuration
+		}
+		return &WindowCheckResult{Banned: true, BanTTL: ttl}, nil
+	}
+
+	result := &WindowCheckResult{}
+	for _, w := range windows {
+		count, err := storage.IncrementBy(ctx, w.Key, cost, w.Window)
+		if err != nil {
+			return nil, err
+		}
+		result.Counts = append(result.Counts, count)
+
+		if count > w.Limit {
+			banDuration := blockDuration
+			if w.ResetAfter > banDuration {
+				banDuration = w.ResetAfter
+			}
+			if err := storage.SetBan(ctx, banKey, banDuration); err != nil {
+				fmt.Printf("failed to set ban: %s: %v\n", banKey, err)
+			}
+			result.Denied = true
+			result.BanTTL = banDuration
+			if ttl, err := storage.GetBanReset(ctx, banKey); err == nil {
+				result.BanTTL = ttl
+			}
+			return result, nil
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,150 @@
+package limiter
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// CleanupStats reports what a SQL storage's janitor has reclaimed since the
+// storage was opened.
+type CleanupStats struct {
+	Runs        int64
+	RowsDeleted map[string]int64
+	LastRun     time.Time
+	LastError   error
+}
+
+// janitorTask deletes at most limit rows of table that expired before now and
+// reports how many it deleted.
+type janitorTask struct {
+	table       string
+	deleteBatch func(ctx context.Context, now time.Time, limit int) (int64, error)
+}
+
+// janitor periodically deletes expired rows from the tables of a SQL storage,
+// which would otherwise keep every window key it ever created. Rows are
+// deleted in batches so that no single statement holds locks for long.
+type janitor struct {
+	name      string
+	tasks     []janitorTask
+	batchSize int
+
+	mu    sync.Mutex
+	stats CleanupStats
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startJanitor runs tasks every interval until stop is called. name prefixes
+// its log lines.
+func startJanitor(name string, interval time.Duration, batchSize int, tasks []janitorTask) *janitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &janitor{
+		name:      name,
+		tasks:     tasks,
+		batchSize: batchSize,
+		stats:     CleanupStats{RowsDeleted: make(map[string]int64)},
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go j.run(ctx, interval)
+	return j
+}
+
+func (j *janitor) run(ctx context.Context, interval time.Duration) {
+	defer close(j.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.sweep(ctx)
+		}
+	}
+}
+
+// sweep empties every table of its expired rows, one batch at a time.
+func (j *janitor) sweep(ctx context.Context) {
+	now := time.Now()
+	deleted := make(map[string]int64)
+	var sweepErr error
+
+	for _, task := range j.tasks {
+		for {
+			n, err := task.deleteBatch(ctx, now, j.batchSize)
+			if n > 0 {
+				deleted[task.table] += n
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[%s] Janitor failed cleaning %s: %v", j.name, task.table, err)
+					sweepErr = err
+				}
+				break
+			}
+			if n < int64(j.batchSize) {
+				break
+			}
+		}
+	}
+
+	var total int64
+	j.mu.Lock()
+	j.stats.Runs++
+	j.stats.LastRun = now
+	j.stats.LastError = sweepErr
+	for table, n := range deleted {
+		j.stats.RowsDeleted[table] += n
+		total += n
+	}
+	j.mu.Unlock()
+
+	if total > 0 {
+		log.Printf("[%s] Janitor reclaimed %d expired rows: %v", j.name, total, deleted)
+	}
+}
+
+// Stats returns a snapshot of the janitor's statistics. A nil janitor, one
+// that was never started, reports none.
+func (j *janitor) Stats() CleanupStats {
+	if j == nil {
+		return CleanupStats{RowsDeleted: map[string]int64{}}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	stats := j.stats
+	stats.RowsDeleted = make(map[string]int64, len(j.stats.RowsDeleted))
+	for table, n := range j.stats.RowsDeleted {
+		stats.RowsDeleted[table] = n
+	}
+	return stats
+}
+
+// stop ends the janitor, aborting a sweep in progress, and waits for it to
+// exit. It is safe to call on a nil janitor.
+func (j *janitor) stop() {
+	if j == nil {
+		return
+	}
+	j.cancel()
+	<-j.done
+}
+
+// deleteRows runs a DELETE statement and reports how many rows it removed.
+func deleteRows(ctx context.Context, db *sql.DB, query string, args ...any) (int64, error) {
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,36 @@
+package limiter_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// TestJanitorReclaimsRequestLogEntries checks that the entries of a sliding
+// log no longer requested are deleted, in batches smaller than their number.
+func TestJanitorReclaimsRequestLogEntries(t *testing.T) {
+	storage, err := limiter.NewSQLiteStorage(filepath.Join(t.TempDir(), "rate_limiter.db"), true, 20*time.Millisecond, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = storage.Close() })
+
+	if _, _, _, err := storage.LogRequest(context.Background(), "log", 5, 10, 50*time.Millisecond); err != nil {
+		t.Fatalf("LogRequest failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		deleted := storage.CleanupStats().RowsDeleted["request_log_entries"]
+		if deleted == 5 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor deleted %d request log entries, want 5", deleted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
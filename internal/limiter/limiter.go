@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,48 +15,240 @@ type Result struct {
 	ResetTime time.Time
 	Limit     int
 	Remaining int
+	Delay     time.Duration
+
+	// Quota is set when a long-term quota applies to the client.
+	// QuotaExceeded tells a rejection because of it apart from one because of
+	// the rate limit.
+	Quota         *QuotaStatus
+	QuotaExceeded bool
+
+	// Rule names the policy rule the request was checked against, if any.
+	// Tier names the tier of the client's token, if it has one.
+	Rule string
+	Tier string
+
+	// Lease is the concurrent request slot an allowed request holds, if a
+	// concurrency limit applies to the client. It must be released once the
+	// request completes. ConcurrencyExceeded tells a rejection because all
+	// slots are taken apart from others.
+	Lease               *Lease
+	ConcurrencyExceeded bool
+
+	cancel func(ctx context.Context) error
 }
 
+// Failure policies decide what happens to a request when its limits cannot be
+// checked because the storage is failing.
+const (
+	// FailurePolicyOpen lets the request through.
+	FailurePolicyOpen = "open"
+	// FailurePolicyClosed rejects the request.
+	FailurePolicyClosed = "closed"
+	// FailurePolicyLocal checks the request against an in-process storage
+	// until the shared one recovers.
+	FailurePolicyLocal = "local"
+)
+
+// RateLimiter checks requests against the limits of a configuration that can
+// be replaced at runtime with Reload. Each call works on the configuration
+// current when it started.
 type RateLimiter struct {
-	config  *config.Config
-	storage StorageStrategy
-	window  time.Duration
+	config     atomic.Pointer[config.Config]
+	storage    StorageStrategy
+	algorithms map[string]Algorithm
+	tiers      localCache[string]
+	overrides  localCache[*Override]
 }
 
 func NewRateLimiter(cfg *config.Config, storage StorageStrategy) *RateLimiter {
-	return &RateLimiter{
-		config:  cfg,
+	rl := &RateLimiter{
 		storage: storage,
-		window:  time.Second,
+		algorithms: map[string]Algorithm{
+			AlgorithmFixedWindow:   NewFixedWindow(storage),
+			AlgorithmTokenBucket:   NewTokenBucket(storage),
+			AlgorithmSlidingWindow: NewSlidingWindow(storage),
+			AlgorithmSlidingLog:    NewSlidingLog(storage),
+			AlgorithmGCRA:          NewGCRA(storage),
+			AlgorithmLeakyBucket:   NewLeakyBucket(storage, cfg.QueueMaxDelay),
+		},
 	}
+	rl.config.Store(cfg)
+	return rl
 }
 
-func (rl *RateLimiter) Check(ctx context.Context, ip, token string) (*Result, error) {
-	var (
-		key   string
-		limit int
-		id    string
-	)
+// Reload makes cfg the configuration of requests checked from now on. Requests
+// being checked finish under the previous one. The storage and the queueing
+// delay of the leaky bucket are set up once and not affected.
+func (rl *RateLimiter) Reload(cfg *config.Config) {
+	rl.config.Store(cfg)
+}
+
+// identity is the client a request is attributed to, together with the limits
+// and quota that apply to it. key is wrapped in braces, a Redis Cluster hash
+// tag, so that every key derived from it maps to the same cluster slot.
+// counterKey, derived from key, is where the rate limit counters and the ban
+// are stored.
+type identity struct {
+	key           string
+	counterKey    string
+	id            string
+	tier          string
+	rule          string
+	algorithm     string
+	limits        []Limit
+	blockDuration time.Duration
+	quota         config.Quota
+	quotaLocation *time.Location
+	concurrency   int
+}
 
+// resolve returns the identity of the client identified by ip and token. A
+// token's own limit and quota take precedence over those of its tier, which
+// take precedence over the token defaults.
+func resolve(cfg *config.Config, ip, token, tier string) identity {
 	if token != "" {
-		if customLimit, exists := rl.config.CustomTokenLimit[token]; exists {
-			key = fmt.Sprintf("token:%s", hashToken(token))
-			limit = customLimit
-			id = fmt.Sprintf("token:%s", maskToken(token))
+		key := tokenKey(token)
+		ident := identity{
+			key:           key,
+			counterKey:    key,
+			id:            fmt.Sprintf("token:%s", maskToken(token)),
+			tier:          tier,
+			algorithm:     cfg.TokenAlgorithm,
+			blockDuration: cfg.BlockDuration,
+			quota:         cfg.TokenQuotaDefault,
+			quotaLocation: cfg.QuotaLocation,
+			concurrency:   cfg.TokenConcurrencyLimit,
+		}
+
+		var tierLimits config.Tier
+		hasTierLimits := false
+		if cfg.Policy != nil && tier != "" {
+			tierLimits, hasTierLimits = cfg.Policy.Tiers[tier]
+		}
+
+		if customLimit, exists := cfg.CustomTokenLimit[token]; exists {
+			ident.limits = stackLimits(Limit{Requests: customLimit.Limit, Window: customLimit.Window, Burst: customLimit.Burst}, customLimit.Extra)
+		} else if hasTierLimits {
+			burst := tierLimits.Burst
+			if burst == 0 {
+				burst = tierLimits.Limit
+			}
+			ident.limits = stackLimits(Limit{Requests: tierLimits.Limit, Window: tierLimits.Window, Burst: burst}, tierLimits.Extra)
 		} else {
-			key = fmt.Sprintf("token:%s", hashToken(token))
-			limit = rl.config.TokenLimitDefault
-			id = fmt.Sprintf("token:%s", maskToken(token))
+			ident.limits = stackLimits(Limit{Requests: cfg.TokenLimitDefault, Window: cfg.TokenWindowDefault, Burst: cfg.TokenBurstDefault}, cfg.TokenExtraDefault)
+		}
+		if hasTierLimits {
+			if tierLimits.Algorithm != "" {
+				ident.algorithm = tierLimits.Algorithm
+			}
+			if tierLimits.BlockDuration > 0 {
+				ident.blockDuration = tierLimits.BlockDuration
+			}
+			if tierLimits.Quota.Limit > 0 {
+				ident.quota = tierLimits.Quota
+			}
+		}
+		if customQuota, exists := cfg.CustomTokenQuota[token]; exists {
+			ident.quota = customQuota
+		}
+		return ident
+	}
+
+	key := ipKey(ip)
+	return identity{
+		key:           key,
+		counterKey:    key,
+		id:            fmt.Sprintf("ip:%s", ip),
+		algorithm:     cfg.IPAlgorithm,
+		limits:        stackLimits(Limit{Requests: cfg.IPLimit, Window: cfg.IPWindow, Burst: cfg.IPBurst}, cfg.IPExtraLimits),
+		blockDuration: cfg.BlockDuration,
+		quota:         cfg.IPQuota,
+		quotaLocation: cfg.QuotaLocation,
+		concurrency:   cfg.IPConcurrencyLimit,
+	}
+}
+
+// identify resolves the client req comes from, the tier of its token and the
+// limits applying to the request under cfg. A policy rule matching the
+// request takes precedence over an override of the client's limits.
+func (rl *RateLimiter) identify(ctx context.Context, cfg *config.Config, req Request) (identity, error) {
+	tier, err := rl.tokenTier(ctx, cfg, req.Token)
+	if err != nil {
+		return identity{}, err
+	}
+
+	ident := resolve(cfg, req.IP, req.Token, tier)
+	applyPolicy(cfg.Policy, &ident, req)
+	if ident.rule != "" {
+		return ident, nil
+	}
+
+	override, err := rl.override(ctx, cfg, "override:"+ident.key)
+	if err != nil {
+		return identity{}, err
+	}
+	if override != nil {
+		applyOverride(&ident, override)
+	}
+	return ident, nil
+}
+
+// Check decides whether a request may proceed, counting it as cost requests
+// against the limits of its client or of the policy rule it matches.
+func (rl *RateLimiter) Check(ctx context.Context, req Request, cost int) (*Result, error) {
+	cfg := rl.config.Load()
+	ident, err := rl.identify(ctx, cfg, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// The concurrent request slot is taken first, so that a request turned
+	// away for want of one has used up none of the rate limit or quota.
+	lease, acquired, err := rl.acquire(ctx, cfg, ident)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *Result
+	if acquired {
+		result, err = rl.check(ctx, ident, cost)
+	} else {
+		result = concurrencyExceeded(ident)
+	}
+	if err != nil || !result.Allowed {
+		if releaseErr := lease.Release(context.WithoutCancel(ctx)); releaseErr != nil {
+			fmt.Printf("failed to release concurrency slot: %v\n", releaseErr)
+		}
+		if err != nil {
+			return nil, err
 		}
 	} else {
-		key = fmt.Sprintf("ip:%s", ip)
-		limit = rl.config.IPLimit
-		id = fmt.Sprintf("ip:%s", ip)
+		result.Lease = lease
+	}
+	result.Rule = ident.rule
+	result.Tier = ident.tier
+	return result, nil
+}
+
+// check decides on a request of the given cost against the limits and quota
+// of ident.
+func (rl *RateLimiter) check(ctx context.Context, ident identity, cost int) (*Result, error) {
+	key, id, limits := ident.counterKey, ident.id, ident.limits
+
+	algorithm, ok := rl.algorithms[ident.algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm: %s", ident.algorithm)
 	}
 
-	windowKey := fmt.Sprintf("%s:%d", key, time.Now().Unix())
 	banKey := fmt.Sprintf("ban:%s", key)
 
+	// Quotas are checked and consumed around the rate limit, so only clients
+	// without one can be decided in a single round trip.
+	if checker, ok := rl.storage.(WindowChecker); ok && ident.algorithm == AlgorithmFixedWindow && ident.quota.Limit == 0 {
+		return rl.checkWindows(ctx, checker, ident, banKey, cost)
+	}
+
 	banned, err := rl.storage.IsBanned(ctx, banKey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check ban status: %w", err)
@@ -64,28 +257,44 @@ func (rl *RateLimiter) Check(ctx context.Context, ip, token string) (*Result, er
 	if banned {
 		ttl, err := rl.storage.GetBanReset(ctx, banKey)
 		if err != nil {
-			ttl = rl.config.BlockDuration
+			ttl = ident.blockDuration
 		}
 		return &Result{
 			Allowed:   false,
 			Reason:    fmt.Sprintf("You have reached the maximum number of requests or actions allowed within a certain time frame"),
 			ResetTime: time.Now().Add(ttl),
-			Limit:     limit,
+			Limit:     limits[0].Requests,
 			Remaining: 0,
 		}, nil
 	}
 
-	count, err := rl.storage.Increment(ctx, windowKey, rl.window)
+	if ident.quota.Limit > 0 {
+		quota, err := rl.quota(ctx, ident)
+		if err != nil {
+			return nil, err
+		}
+		if quota.Remaining < cost {
+			return quotaExceeded(quota, limits[0].Requests), nil
+		}
+	}
+
+	decision, err := rl.evaluate(ctx, algorithm, key, limits, cost)
 	if err != nil {
-		return nil, fmt.Errorf("failed to increment rate counter: %w", err)
+		return nil, err
 	}
 
-	if count > limit {
-		if err := rl.storage.SetBan(ctx, banKey, rl.config.BlockDuration); err != nil {
+	if !decision.Allowed {
+		// A long window (e.g. a daily limit) would let the client straight
+		// back in when a shorter ban ran out, so the ban covers both.
+		banDuration := ident.blockDuration
+		if decision.ResetAfter > banDuration {
+			banDuration = decision.ResetAfter
+		}
+		if err := rl.storage.SetBan(ctx, banKey, banDuration); err != nil {
 			fmt.Printf("failed to set ban: %s: %v\n", id, err)
 		}
 
-		ttl := rl.config.BlockDuration
+		ttl := banDuration
 		if t, err := rl.storage.GetBanReset(ctx, banKey); err == nil {
 			ttl = t
 		}
@@ -94,30 +303,211 @@ func (rl *RateLimiter) Check(ctx context.Context, ip, token string) (*Result, er
 			Allowed:   false,
 			Reason:    fmt.Sprintf("You have reached the maximum number of requests or actions allowed within a certain time frame"),
 			ResetTime: time.Now().Add(ttl),
-			Limit:     limit,
+			Limit:     decision.Limit,
 			Remaining: 0,
 		}, nil
 	}
 
-	remaining := limit - count
-	if remaining < 0 {
-		remaining = 0
+	var quota *QuotaStatus
+	if ident.quota.Limit > 0 {
+		quota, err = rl.consumeQuota(ctx, ident, cost)
+		if err != nil {
+			return nil, err
+		}
+		// Concurrent requests may have used up the quota since it was read.
+		if quota.Used > quota.Limit {
+			if decision.cancel != nil {
+				_ = decision.cancel(ctx)
+			}
+			return quotaExceeded(quota, decision.Limit), nil
+		}
 	}
 
 	return &Result{
 		Allowed:   true,
-		Reason:    fmt.Sprintf("Request allowed for %s (%d/%d requests)", id, count, limit),
-		ResetTime: time.Now().Add(rl.window),
-		Limit:     limit,
-		Remaining: remaining,
+		Reason:    fmt.Sprintf("Request allowed for %s (%d/%d requests)", id, decision.Limit-decision.Remaining, decision.Limit),
+		ResetTime: time.Now().Add(decision.ResetAfter),
+		Limit:     decision.Limit,
+		Remaining: decision.Remaining,
+		Delay:     decision.Delay,
+		Quota:     quota,
+		cancel:    decision.cancel,
 	}, nil
 
 }
 
+func quotaExceeded(quota *QuotaStatus, limit int) *Result {
+	return &Result{
+		Allowed:       false,
+		Reason:        fmt.Sprintf("You have used up your quota of %d requests per %s", quota.Limit, quota.Period),
+		ResetTime:     quota.ResetTime,
+		Limit:         limit,
+		Remaining:     0,
+		Quota:         quota,
+		QuotaExceeded: true,
+	}
+}
+
+// evaluate applies each of an identity's limits in turn and stops at the first
+// one rejecting the request. Otherwise it reports the most restrictive limit,
+// the one with the fewest requests remaining.
+func (rl *RateLimiter) evaluate(ctx context.Context, algorithm Algorithm, key string, limits []Limit, cost int) (*Decision, error) {
+	var (
+		tightest *Decision
+		cancels  []func(ctx context.Context) error
+		delay    time.Duration
+	)
+
+	for i, limit := range limits {
+		decision, err := algorithm.Allow(ctx, limitKey(key, i, limit), limit, cost)
+		if err != nil {
+			return nil, err
+		}
+		if !decision.Allowed {
+			_ = releaseAll(ctx, cancels)
+			return decision, nil
+		}
+
+		if decision.cancel != nil {
+			cancels = append(cancels, decision.cancel)
+		}
+		if decision.Delay > delay {
+			delay = decision.Delay
+		}
+		if tightest == nil || decision.Remaining < tightest.Remaining ||
+			(decision.Remaining == tightest.Remaining && decision.ResetAfter > tightest.ResetAfter) {
+			tightest = decision
+		}
+	}
+
+	combined := *tightest
+	combined.Delay = delay
+	combined.cancel = nil
+	if len(cancels) > 0 {
+		combined.cancel = func(ctx context.Context) error {
+			return releaseAll(ctx, cancels)
+		}
+	}
+	return &combined, nil
+}
+
+// limitKey returns the key the i-th of an identity's limits is stored under.
+func limitKey(key string, i int, limit Limit) string {
+	if i == 0 {
+		return key
+	}
+	return fmt.Sprintf("%s:%v", key, limit.Window)
+}
+
+// RouteCost returns how many requests a call to the given gin route counts as,
+// preferring a cost configured for the method and route over one for the
+// route alone.
+func (rl *RateLimiter) RouteCost(method, route string) int {
+	cfg := rl.config.Load()
+	if cost, ok := cfg.RouteCosts[method+" "+route]; ok {
+		return cost
+	}
+	if cost, ok := cfg.RouteCosts[route]; ok {
+		return cost
+	}
+	return 1
+}
+
+// Charge counts n further requests against the limits and quota a request was
+// checked against without rejecting anything. It lets a handler bill work
+// whose cost is only known once the request has been served.
+func (rl *RateLimiter) Charge(ctx context.Context, req Request, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	ident, err := rl.identify(ctx, rl.config.Load(), req)
+	if err != nil {
+		return err
+	}
+	algorithm, ok := rl.algorithms[ident.algorithm]
+	if !ok {
+		return fmt.Errorf("unknown algorithm: %s", ident.algorithm)
+	}
+
+	if _, err := rl.evaluate(ctx, algorithm, ident.counterKey, ident.limits, n); err != nil {
+		return err
+	}
+	if ident.quota.Limit > 0 {
+		if _, err := rl.consumeQuota(ctx, ident, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseAll gives back every queue slot reserved for a request, returning the
+// first error encountered.
+func releaseAll(ctx context.Context, cancels []func(ctx context.Context) error) error {
+	var firstErr error
+	for _, cancel := range cancels {
+		if err := cancel(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// stackLimits returns primary followed by the extra limits configured for the
+// same identity. Extra limits allow no burst beyond their own size.
+func stackLimits(primary Limit, extra []config.WindowLimit) []Limit {
+	limits := []Limit{primary}
+	for _, l := range extra {
+		limits = append(limits, Limit{Requests: l.Limit, Window: l.Window, Burst: l.Limit})
+	}
+	return limits
+}
+
+// Wait blocks until the slot of a queued request comes up. If ctx is done
+// first, the slot is given back where possible and ctx's error is returned.
+func (rl *RateLimiter) Wait(ctx context.Context, result *Result) error {
+	if result.Delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(result.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if result.cancel != nil {
+			if err := result.cancel(context.WithoutCancel(ctx)); err != nil {
+				fmt.Printf("failed to release queue slot: %v\n", err)
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// FailurePolicy returns how requests are to be handled when their limits
+// cannot be checked, and how long clients should wait before retrying when
+// they are rejected for it.
+func (rl *RateLimiter) FailurePolicy() (string, time.Duration) {
+	cfg := rl.config.Load()
+	return cfg.FailurePolicy, cfg.BreakerCooldown
+}
+
 func (rl *RateLimiter) Close() error {
 	return rl.storage.Close()
 }
 
+// ipKey and tokenKey return the key of the client identified by an IP or a
+// token.
+func ipKey(ip string) string {
+	return fmt.Sprintf("{ip:%s}", ip)
+}
+
+func tokenKey(token string) string {
+	return fmt.Sprintf("{token:%s}", hashToken(token))
+}
+
 func hashToken(token string) string {
 	if len(token) < 8 {
 		return token
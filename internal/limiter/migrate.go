@@ -0,0 +1,342 @@
+package limiter
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// migrationFS holds the schema of each SQL dialect as numbered scripts, e.g.
+// migrations/mysql/0002_expires_at_indexes.sql. A script is applied once, in
+// order, and never edited after release; schema changes go in a new script.
+//
+//go:embed migrations
+var migrationFS embed.FS
+
+// ErrSchemaTooNew is returned when the database has been migrated by a newer
+// release than this binary, whose queries may no longer match the schema.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary supports")
+
+// ErrSchemaOutdated is returned when migrations are pending and the storage
+// was asked not to apply them itself.
+var ErrSchemaOutdated = errors.New("database schema is out of date, run the migrate command")
+
+type migration struct {
+	version    int
+	name       string
+	statements []string
+}
+
+// sqlDialect names a migrations directory together with the bind parameter
+// syntax of its database. lock, if set, keeps other processes from migrating
+// the database until the returned function is called. alreadyExists reports
+// an error creating a column or index a previous, interrupted run created.
+type sqlDialect struct {
+	name          string
+	placeholder   func(i int) string
+	lock          func(ctx context.Context, conn *sql.Conn) (func(), error)
+	alreadyExists func(err error) bool
+}
+
+var (
+	mysqlDialect = sqlDialect{
+		name:          "mysql",
+		placeholder:   func(int) string { return "?" },
+		lock:          lockMySQL,
+		alreadyExists: mysqlAlreadyExists,
+	}
+	postgresDialect = sqlDialect{
+		name:        "postgres",
+		placeholder: func(i int) string { return "$" + strconv.Itoa(i) },
+		lock:        lockPostgres,
+	}
+	// SQLite transactions take the write lock when they begin, which keeps
+	// other processes out while a migration is applied.
+	sqliteDialect = sqlDialect{name: "sqlite", placeholder: func(int) string { return "?" }}
+)
+
+// migrationLock names the lock replicas starting together take before
+// migrating, so that only one of them applies each migration.
+const migrationLock = "rate_limiter_migrate"
+
+// migrationLockTimeout is how long MySQL waits for another process to finish
+// migrating.
+const migrationLockTimeout = 5 * time.Minute
+
+// sqlQuerier is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// MigrateSQL opens the database of the given SQL backend ("mysql", "postgres"
+// or "sqlite") and applies any pending migrations. It returns the schema
+// version found and the one the database was brought to.
+func MigrateSQL(ctx context.Context, backend, dsn string) (int, int, error) {
+	var (
+		db      *sql.DB
+		dialect sqlDialect
+		err     error
+	)
+	switch backend {
+	case "mysql":
+		db, err = openMySQL(dsn)
+		dialect = mysqlDialect
+	case "postgres":
+		db, err = openPostgres(dsn)
+		dialect = postgresDialect
+	case "sqlite":
+		db, err = openSQLite(dsn)
+		dialect = sqliteDialect
+	default:
+		return 0, 0, fmt.Errorf("storage backend %s has no schema to migrate", backend)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+
+	return migrate(ctx, db, dialect)
+}
+
+// prepareSchema brings a storage's database up to date at startup, or only
+// checks that it is when autoMigrate is off.
+func prepareSchema(ctx context.Context, db *sql.DB, dialect sqlDialect, autoMigrate bool) error {
+	if autoMigrate {
+		from, to, err := migrate(ctx, db, dialect)
+		if err != nil {
+			return err
+		}
+		if from != to {
+			log.Printf("[Migrate] Migrated %s schema from version %d to %d", dialect.name, from, to)
+		}
+		return nil
+	}
+
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	return checkSchemaVersion(current, latestVersion(migrations))
+}
+
+func migrate(ctx context.Context, db *sql.DB, dialect sqlDialect) (int, int, error) {
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Locks are held by a session, so everything runs on one connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	if dialect.lock != nil {
+		unlock, err := dialect.lock(ctx, conn)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to take the migration lock: %w", err)
+		}
+		defer unlock()
+	}
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INT PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)`); err != nil {
+		return 0, 0, fmt.Errorf("create table schema_version: %w", err)
+	}
+
+	from, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := checkSchemaVersion(from, latestVersion(migrations)); err != nil && !errors.Is(err, ErrSchemaOutdated) {
+		return from, from, err
+	}
+
+	to := from
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+		if err := applyMigration(ctx, conn, dialect, m); err != nil {
+			return from, to, err
+		}
+		to = m.version
+	}
+	return from, to, nil
+}
+
+// applyMigration runs a migration's statements and records it in a single
+// transaction, unless another process applied it in the meantime. MySQL
+// commits DDL statements implicitly, so a migration failing halfway there is
+// run again from the start, skipping the columns and indexes it created.
+func applyMigration(ctx context.Context, conn *sql.Conn, dialect sqlDialect, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current >= m.version {
+		return nil
+	}
+
+	for _, statement := range m.statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			if dialect.alreadyExists != nil && dialect.alreadyExists(err) {
+				continue
+			}
+			return fmt.Errorf("migration %04d_%s: %w", m.version, m.name, err)
+		}
+	}
+
+	insert := fmt.Sprintf(`INSERT INTO schema_version (version, name) VALUES (%s, %s)`, dialect.placeholder(1), dialect.placeholder(2))
+	if _, err := tx.ExecContext(ctx, insert, m.version, m.name); err != nil {
+		return fmt.Errorf("record migration %04d_%s: %w", m.version, m.name, err)
+	}
+	return tx.Commit()
+}
+
+// schemaVersion returns the latest migration applied to db, or 0 if none has
+// been.
+func schemaVersion(ctx context.Context, db sqlQuerier) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version)
+	if err != nil {
+		// A database never migrated has no schema_version table.
+		if _, tableErr := db.ExecContext(ctx, `SELECT 1 FROM schema_version WHERE 1 = 0`); tableErr != nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed reading schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// lockMySQL takes a named lock, released when conn's session ends at the
+// latest.
+func lockMySQL(ctx context.Context, conn *sql.Conn) (func(), error) {
+	var acquired sql.NullInt64
+	err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLock, int(migrationLockTimeout.Seconds())).Scan(&acquired)
+	if err != nil {
+		return nil, err
+	}
+	if acquired.Int64 != 1 {
+		return nil, fmt.Errorf("another process has been migrating for over %v", migrationLockTimeout)
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrationLock)
+	}, nil
+}
+
+// mysqlAlreadyExists reports a duplicate column (1060) or index (1061) error.
+func mysqlAlreadyExists(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && (mysqlErr.Number == 1060 || mysqlErr.Number == 1061)
+}
+
+// lockPostgres takes a session-level advisory lock, keyed by a hash of
+// migrationLock, released when conn's session ends at the latest.
+func lockPostgres(ctx context.Context, conn *sql.Conn) (func(), error) {
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, migrationLock); err != nil {
+		return nil, err
+	}
+	return func() {
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1))`, migrationLock)
+	}, nil
+}
+
+func checkSchemaVersion(current, latest int) error {
+	if current > latest {
+		return fmt.Errorf("%w: schema version %d, binary supports up to %d", ErrSchemaTooNew, current, latest)
+	}
+	if current < latest {
+		return fmt.Errorf("%w: schema version %d, binary expects %d", ErrSchemaOutdated, current, latest)
+	}
+	return nil
+}
+
+func latestVersion(migrations []migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].version
+}
+
+// loadMigrations reads the migrations of a dialect, sorted by version.
+func loadMigrations(dialect sqlDialect) ([]migration, error) {
+	dir := path.Join("migrations", dialect.name)
+	entries, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s migrations: %w", dialect.name, err)
+	}
+
+	var migrations []migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		if entry.IsDir() || name == entry.Name() {
+			continue
+		}
+		prefix, rest, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		content, err := fs.ReadFile(migrationFS, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed reading migration %s: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, migration{
+			version:    version,
+			name:       rest,
+			statements: splitStatements(string(content)),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d for %s", migrations[i].version, dialect.name)
+		}
+	}
+	return migrations, nil
+}
+
+// splitStatements breaks a migration script into statements, dropping comment
+// lines. Statements end with a semicolon; none of the scripts needs one inside
+// a statement.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
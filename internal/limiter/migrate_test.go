@@ -0,0 +1,59 @@
+package limiter_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// TestMigrateSQLConcurrently starts several migrations of a new database at
+// once, as replicas starting together do, and checks that each migration is
+// applied exactly once.
+func TestMigrateSQLConcurrently(t *testing.T) {
+	const replicas = 10
+
+	path := filepath.Join(t.TempDir(), "rate_limiter.db")
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		tos   = make(chan int, replicas)
+		errs  = make(chan error, replicas)
+	)
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, to, err := limiter.MigrateSQL(context.Background(), "sqlite", path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			tos <- to
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(tos)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("MigrateSQL failed: %v", err)
+	}
+
+	from, to, err := limiter.MigrateSQL(context.Background(), "sqlite", path)
+	if err != nil {
+		t.Fatalf("MigrateSQL failed: %v", err)
+	}
+	if from != to {
+		t.Errorf("MigrateSQL of a migrated database went from version %d to %d", from, to)
+	}
+	for version := range tos {
+		if version != to {
+			t.Errorf("MigrateSQL brought the database to version %d, want %d", version, to)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS rate_limits (k VARCHAR(255) PRIMARY KEY, count INT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS bans (k VARCHAR(255) PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS token_buckets (k VARCHAR(255) PRIMARY KEY, tokens DOUBLE NOT NULL, updated_at BIGINT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS request_logs (k VARCHAR(255) PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS request_log_entries (id BIGINT AUTO_INCREMENT PRIMARY KEY, k VARCHAR(255) NOT NULL, ts BIGINT NOT NULL, INDEX idx_request_log_entries_k_ts (k, ts));
+CREATE TABLE IF NOT EXISTS gcra_tats (k VARCHAR(255) PRIMARY KEY, tat BIGINT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS lease_sets (k VARCHAR(255) PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS leases (k VARCHAR(255) NOT NULL, id VARCHAR(64) NOT NULL, expires_at BIGINT NOT NULL, PRIMARY KEY (k, id));
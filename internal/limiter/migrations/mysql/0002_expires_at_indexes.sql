@@ -0,0 +1,8 @@
+-- Lets the janitor find expired rows without scanning whole tables.
+CREATE INDEX idx_rate_limits_expires_at ON rate_limits (expires_at);
+CREATE INDEX idx_bans_expires_at ON bans (expires_at);
+CREATE INDEX idx_token_buckets_expires_at ON token_buckets (expires_at);
+CREATE INDEX idx_request_logs_expires_at ON request_logs (expires_at);
+CREATE INDEX idx_gcra_tats_expires_at ON gcra_tats (expires_at);
+CREATE INDEX idx_lease_sets_expires_at ON lease_sets (expires_at);
+CREATE INDEX idx_leases_expires_at ON leases (expires_at);
@@ -0,0 +1,2 @@
+-- Maps API tokens to the tier whose limits they get, for RL_TOKEN_TIER_SOURCE=storage.
+CREATE TABLE IF NOT EXISTS token_tiers (token VARCHAR(255) PRIMARY KEY, tier VARCHAR(64) NOT NULL);
@@ -0,0 +1,2 @@
+-- Limits set at runtime for single clients, until expires_at (unix milliseconds).
+CREATE TABLE IF NOT EXISTS limit_overrides (k VARCHAR(255) PRIMARY KEY, request_limit INT NOT NULL, window_ms BIGINT NOT NULL, burst INT NOT NULL, expires_at BIGINT NOT NULL, INDEX idx_limit_overrides_expires_at (expires_at));
@@ -0,0 +1,4 @@
+-- Lets the janitor delete log entries on their own. Entries already logged
+-- expire with their log's head row, or at once if it was deleted.
+ALTER TABLE request_log_entries ADD COLUMN expires_at TIMESTAMP NULL, ADD INDEX idx_request_log_entries_expires_at (expires_at);
+UPDATE request_log_entries e LEFT JOIN request_logs l ON l.k = e.k SET e.expires_at = COALESCE(l.expires_at, TIMESTAMP '1970-01-02 00:00:00');
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS rate_limits (k TEXT PRIMARY KEY, count INT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS bans (k TEXT PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS token_buckets (k TEXT PRIMARY KEY, tokens DOUBLE PRECISION NOT NULL, updated_at BIGINT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS request_logs (k TEXT PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS request_log_entries (id BIGSERIAL PRIMARY KEY, k TEXT NOT NULL, ts BIGINT NOT NULL);
+CREATE INDEX IF NOT EXISTS idx_request_log_entries_k_ts ON request_log_entries (k, ts);
+CREATE TABLE IF NOT EXISTS gcra_tats (k TEXT PRIMARY KEY, tat BIGINT NOT NULL, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS lease_sets (k TEXT PRIMARY KEY, expires_at TIMESTAMP);
+CREATE TABLE IF NOT EXISTS leases (k TEXT NOT NULL, id TEXT NOT NULL, expires_at BIGINT NOT NULL, PRIMARY KEY (k, id));
@@ -0,0 +1,2 @@
+-- Maps API tokens to the tier whose limits they get, for RL_TOKEN_TIER_SOURCE=storage.
+CREATE TABLE IF NOT EXISTS token_tiers (token TEXT PRIMARY KEY, tier TEXT NOT NULL);
@@ -0,0 +1,5 @@
+-- Lets the janitor delete log entries on their own. Entries already logged
+-- expire with their log's head row, or at once if it was deleted.
+ALTER TABLE request_log_entries ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP;
+UPDATE request_log_entries e SET expires_at = COALESCE((SELECT l.expires_at FROM request_logs l WHERE l.k = e.k), TIMESTAMP '1970-01-01 00:00:00');
+CREATE INDEX IF NOT EXISTS idx_request_log_entries_expires_at ON request_log_entries (expires_at);
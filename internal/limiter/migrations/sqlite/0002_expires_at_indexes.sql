@@ -0,0 +1,6 @@
+-- Lets the janitor find expired rows without scanning whole tables.
+CREATE INDEX IF NOT EXISTS idx_rate_limits_expires_at ON rate_limits (expires_at);
+CREATE INDEX IF NOT EXISTS idx_bans_expires_at ON bans (expires_at);
+CREATE INDEX IF NOT EXISTS idx_token_buckets_expires_at ON token_buckets (expires_at);
+CREATE INDEX IF NOT EXISTS idx_gcra_tats_expires_at ON gcra_tats (expires_at);
+CREATE INDEX IF NOT EXISTS idx_leases_expires_at ON leases (expires_at);
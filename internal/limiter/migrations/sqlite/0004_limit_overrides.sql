@@ -0,0 +1,3 @@
+-- Limits set at runtime for single clients, until expires_at (unix milliseconds).
+CREATE TABLE IF NOT EXISTS limit_overrides (k TEXT PRIMARY KEY, request_limit INTEGER NOT NULL, window_ms INTEGER NOT NULL, burst INTEGER NOT NULL, expires_at INTEGER NOT NULL);
+CREATE INDEX IF NOT EXISTS idx_limit_overrides_expires_at ON limit_overrides (expires_at);
@@ -0,0 +1,5 @@
+-- Lets the janitor delete log entries (expires_at in unix milliseconds). The
+-- window of entries already logged is unknown, so they are kept for a day.
+ALTER TABLE request_log_entries ADD COLUMN expires_at INTEGER;
+UPDATE request_log_entries SET expires_at = ts / 1000 + 86400000;
+CREATE INDEX IF NOT EXISTS idx_request_log_entries_expires_at ON request_log_entries (expires_at);
@@ -0,0 +1,163 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+// ErrInvalidIdentity is returned for an identity other than "ip:<address>" or
+// "token:<token>".
+var ErrInvalidIdentity = errors.New("invalid identity")
+
+// ErrInvalidOverride is returned for an override without a positive limit, a
+// window of whole milliseconds, or expiring in the past.
+var ErrInvalidOverride = errors.New("invalid override")
+
+// Override replaces the rate limit of a client until ExpiresAt, e.g. to raise
+// a customer's limit during an incident or to throttle an abusive IP. A zero
+// Burst defaults to Limit.
+type Override struct {
+	Limit     int
+	Window    time.Duration
+	Burst     int
+	ExpiresAt time.Time
+}
+
+// SetOverride replaces the rate limit of identity, "ip:<address>" or
+// "token:<token>", with override until it expires. Other instances pick it up
+// within the override cache TTL.
+func (rl *RateLimiter) SetOverride(ctx context.Context, identity string, override Override) error {
+	key, err := overrideKey(identity)
+	if err != nil {
+		return err
+	}
+	switch {
+	case override.Limit <= 0:
+		return fmt.Errorf("%w: limit must be positive, got %d", ErrInvalidOverride, override.Limit)
+	case override.Window <= 0:
+		return fmt.Errorf("%w: window must be positive, got %v", ErrInvalidOverride, override.Window)
+	case override.Window%time.Millisecond != 0:
+		// Storages keep windows in milliseconds.
+		return fmt.Errorf("%w: window must be a whole number of milliseconds, got %v", ErrInvalidOverride, override.Window)
+	case override.Burst < 0:
+		return fmt.Errorf("%w: burst must not be negative, got %d", ErrInvalidOverride, override.Burst)
+	case !override.ExpiresAt.After(time.Now()):
+		return fmt.Errorf("%w: expiry %v is in the past", ErrInvalidOverride, override.ExpiresAt)
+	}
+
+	if err := rl.storage.SetOverride(ctx, key, override); err != nil {
+		return fmt.Errorf("failed to store override: %w", err)
+	}
+	rl.overrides.delete(key)
+	return nil
+}
+
+// Override returns the override of identity, or nil if it has none.
+func (rl *RateLimiter) Override(ctx context.Context, identity string) (*Override, error) {
+	key, err := overrideKey(identity)
+	if err != nil {
+		return nil, err
+	}
+	override, err := rl.storage.GetOverride(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read override: %w", err)
+	}
+	return override, nil
+}
+
+// DeleteOverride gives identity its usual limits back.
+func (rl *RateLimiter) DeleteOverride(ctx context.Context, identity string) error {
+	key, err := overrideKey(identity)
+	if err != nil {
+		return err
+	}
+	if err := rl.storage.DeleteOverride(ctx, key); err != nil {
+		return fmt.Errorf("failed to delete override: %w", err)
+	}
+	rl.overrides.delete(key)
+	return nil
+}
+
+// override returns the unexpired override stored under key, if any, caching
+// what the storage says for cfg's override cache TTL.
+func (rl *RateLimiter) override(ctx context.Context, cfg *config.Config, key string) (*Override, error) {
+	override, ok := rl.overrides.get(key)
+	if !ok {
+		var err error
+		override, err = rl.storage.GetOverride(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read override: %w", err)
+		}
+		rl.overrides.put(key, override, cfg.OverrideCacheTTL)
+	}
+
+	// A window lost to rounding, stored before windows were checked, would
+	// leave the algorithms dividing by zero.
+	if override == nil || override.Window <= 0 || !override.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return override, nil
+}
+
+// applyOverride replaces the limits of ident with override.
+func applyOverride(ident *identity, override *Override) {
+	burst := override.Burst
+	if burst == 0 {
+		burst = override.Limit
+	}
+	ident.limits = []Limit{{Requests: override.Limit, Window: override.Window, Burst: burst}}
+	ident.id = fmt.Sprintf("%s override", ident.id)
+}
+
+// overrideKey returns the key the override of identity is stored under,
+// derived from the key of the identity itself.
+func overrideKey(identity string) (string, error) {
+	kind, value, _ := strings.Cut(identity, ":")
+	switch kind {
+	case "ip":
+		if ip := net.ParseIP(value); ip != nil {
+			return "override:" + ipKey(ip.String()), nil
+		}
+	case "token":
+		if value != "" {
+			return "override:" + tokenKey(value), nil
+		}
+	}
+	return "", fmt.Errorf("%w %q (expected ip:<address> or token:<token>)", ErrInvalidIdentity, identity)
+}
+
+// formatOverride encodes an override for storages holding plain values, as
+// its limit, window (milliseconds), burst and expiry (unix milliseconds)
+// separated by spaces.
+func formatOverride(override Override) []byte {
+	return []byte(fmt.Sprintf("%d %d %d %d", override.Limit, override.Window.Milliseconds(), override.Burst, override.ExpiresAt.UnixMilli()))
+}
+
+func parseOverride(value []byte) (*Override, error) {
+	fields := strings.Fields(string(value))
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid override: %q", value)
+	}
+
+	var numbers [4]int64
+	for i, field := range fields {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid override: %q", value)
+		}
+		numbers[i] = n
+	}
+	return &Override{
+		Limit:     int(numbers[0]),
+		Window:    time.Duration(numbers[1]) * time.Millisecond,
+		Burst:     int(numbers[2]),
+		ExpiresAt: time.UnixMilli(numbers[3]),
+	}, nil
+}
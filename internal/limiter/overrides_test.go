@@ -0,0 +1,126 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// testConfig limits clients by IP address to 2 requests a minute.
+func testConfig() *config.Config {
+	return &config.Config{
+		IPLimit:             2,
+		IPWindow:            time.Minute,
+		IPBurst:             2,
+		IPAlgorithm:         limiter.AlgorithmFixedWindow,
+		BlockDuration:       time.Minute,
+		QuotaLocation:       time.UTC,
+		ConcurrencyLeaseTTL: time.Minute,
+	}
+}
+
+func newTestLimiter(t *testing.T, cfg *config.Config, storage limiter.StorageStrategy) *limiter.RateLimiter {
+	t.Helper()
+	rl := limiter.NewRateLimiter(cfg, storage)
+	t.Cleanup(func() { _ = rl.Close() })
+	return rl
+}
+
+func TestSetOverrideRejectsInvalidWindows(t *testing.T) {
+	rl := newTestLimiter(t, testConfig(), newSQLiteStorage(t))
+	expiresAt := time.Now().Add(time.Hour)
+
+	for _, window := range []time.Duration{0, -time.Second, 500 * time.Microsecond, 1500 * time.Microsecond} {
+		err := rl.SetOverride(context.Background(), "ip:10.0.0.1", limiter.Override{Limit: 10, Window: window, ExpiresAt: expiresAt})
+		if !errors.Is(err, limiter.ErrInvalidOverride) {
+			t.Errorf("SetOverride with window %v = %v, want ErrInvalidOverride", window, err)
+		}
+	}
+}
+
+// TestOverrideRoundTrip stores an override in SQLite, whose columns hold
+// windows and expiry times in milliseconds, and checks requests are decided
+// against what is read back.
+func TestOverrideRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	rl := newTestLimiter(t, testConfig(), newSQLiteStorage(t))
+
+	override := limiter.Override{Limit: 4, Window: 250 * time.Millisecond, ExpiresAt: time.Now().Add(time.Hour).Truncate(time.Millisecond)}
+	if err := rl.SetOverride(ctx, "ip:10.0.0.1", override); err != nil {
+		t.Fatalf("SetOverride failed: %v", err)
+	}
+
+	got, err := rl.Override(ctx, "ip:10.0.0.1")
+	if err != nil {
+		t.Fatalf("Override failed: %v", err)
+	}
+	if got == nil || got.Limit != override.Limit || got.Window != override.Window || !got.ExpiresAt.Equal(override.ExpiresAt) {
+		t.Fatalf("Override = %+v, want %+v", got, override)
+	}
+
+	req := limiter.Request{IP: "10.0.0.1", Method: http.MethodGet, Path: "/ping", Header: http.Header{}}
+	for i := 1; i <= 5; i++ {
+		result, err := rl.Check(ctx, req, 1)
+		if err != nil {
+			t.Fatalf("Check %d failed: %v", i, err)
+		}
+		if result.Limit != override.Limit {
+			t.Errorf("Check %d limit = %d, want %d", i, result.Limit, override.Limit)
+		}
+		if want := i <= override.Limit; result.Allowed != want {
+			t.Errorf("Check %d allowed = %v, want %v", i, result.Allowed, want)
+		}
+	}
+
+	if err := rl.DeleteOverride(ctx, "ip:10.0.0.1"); err != nil {
+		t.Fatalf("DeleteOverride failed: %v", err)
+	}
+	if got, err := rl.Override(ctx, "ip:10.0.0.1"); err != nil || got != nil {
+		t.Errorf("Override after DeleteOverride = %+v, %v, want none", got, err)
+	}
+}
+
+// TestOverrideWithRouteRule checks that an override replaces the client's
+// usual limit only, leaving requests matching a policy rule to the rule.
+func TestOverrideWithRouteRule(t *testing.T) {
+	ctx := context.Background()
+	cfg := testConfig()
+	cfg.Policy = &config.Policy{Rules: []config.Rule{
+		{Name: "orders-write", Match: config.RuleMatch{Route: "/orders", Methods: []string{http.MethodPost}}, Limit: 1, Window: time.Minute},
+	}}
+	rl := newTestLimiter(t, cfg, newMemoryStorage(t))
+
+	override := limiter.Override{Limit: 4, Window: time.Minute, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := rl.SetOverride(ctx, "ip:10.0.0.1", override); err != nil {
+		t.Fatalf("SetOverride failed: %v", err)
+	}
+
+	steps := []struct {
+		method, route string
+		wantAllowed   bool
+		wantRule      string
+		wantLimit     int
+	}{
+		{http.MethodPost, "/orders", true, "orders-write", 1},
+		{http.MethodPost, "/orders", false, "orders-write", 1},
+		{http.MethodGet, "/orders", true, "", 4},
+		{http.MethodGet, "/ping", true, "", 4},
+		{http.MethodGet, "/ping", true, "", 4},
+	}
+	for i, step := range steps {
+		req := limiter.Request{IP: "10.0.0.1", Method: step.method, Route: step.route, Path: step.route, Header: http.Header{}}
+		result, err := rl.Check(ctx, req, 1)
+		if err != nil {
+			t.Fatalf("Check %d failed: %v", i+1, err)
+		}
+		if result.Allowed != step.wantAllowed || result.Rule != step.wantRule || result.Limit != step.wantLimit {
+			t.Errorf("Check %d: %s %s = allowed %v, rule %q, limit %d; want %v, %q, %d", i+1, step.method, step.route,
+				result.Allowed, result.Rule, result.Limit, step.wantAllowed, step.wantRule, step.wantLimit)
+		}
+	}
+}
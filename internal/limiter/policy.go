@@ -0,0 +1,86 @@
+package limiter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+// Request holds what the rate limiter knows of an incoming request: the
+// client it comes from and the attributes policy rules match on.
+type Request struct {
+	IP     string
+	Token  string
+	Method string
+	Path   string
+	// Route is the pattern of the route serving the request, e.g.
+	// "/users/:id", or empty if no route matches it.
+	Route  string
+	Header http.Header
+}
+
+// applyPolicy replaces the limits of ident with those of the first policy rule
+// matching req, if any. Each rule counts requests and bans clients under its
+// own keys, apart from the client's other limits.
+func applyPolicy(policy *config.Policy, ident *identity, req Request) {
+	if policy == nil {
+		return
+	}
+
+	for i := range policy.Rules {
+		rule := &policy.Rules[i]
+		if !ruleMatches(rule.Match, req, ident.tier) {
+			continue
+		}
+
+		burst := rule.Burst
+		if burst == 0 {
+			burst = rule.Limit
+		}
+		ident.counterKey = fmt.Sprintf("%s:rule:%s", ident.key, rule.Name)
+		ident.id = fmt.Sprintf("%s rule:%s", ident.id, rule.Name)
+		ident.rule = rule.Name
+		ident.limits = []Limit{{Requests: rule.Limit, Window: rule.Window, Burst: burst}}
+		if rule.Algorithm != "" {
+			ident.algorithm = rule.Algorithm
+		}
+		if rule.BlockDuration > 0 {
+			ident.blockDuration = rule.BlockDuration
+		}
+		return
+	}
+}
+
+func ruleMatches(match config.RuleMatch, req Request, tier string) bool {
+	if match.Route != "" && match.Route != req.Route {
+		return false
+	}
+	if match.Path != "" {
+		if ok, _ := path.Match(match.Path, req.Path); !ok {
+			return false
+		}
+	}
+	if len(match.Methods) > 0 && !slices.Contains(match.Methods, req.Method) {
+		return false
+	}
+	for name, value := range match.Headers {
+		values := req.Header.Values(name)
+		if len(values) == 0 || (value != "*" && !slices.Contains(values, value)) {
+			return false
+		}
+	}
+	if len(match.IPRanges) > 0 {
+		ip := net.ParseIP(req.IP)
+		if ip == nil || !slices.ContainsFunc(match.IPRanges, func(r *net.IPNet) bool { return r.Contains(ip) }) {
+			return false
+		}
+	}
+	if len(match.TokenTiers) > 0 && (tier == "" || !slices.Contains(match.TokenTiers, tier)) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+const (
+	QuotaPeriodDay   = "day"
+	QuotaPeriodMonth = "month"
+)
+
+// QuotaStatus describes how much of its long-term quota an identity has used
+// in the current calendar period.
+type QuotaStatus struct {
+	Limit     int
+	Used      int
+	Remaining int
+	Period    string
+	ResetTime time.Time
+}
+
+// Quota reports the quota status of the client identified by ip and token
+// without counting a request against it. It returns nil if no quota applies.
+func (rl *RateLimiter) Quota(ctx context.Context, ip, token string) (*QuotaStatus, error) {
+	ident, err := rl.identify(ctx, rl.config.Load(), Request{IP: ip, Token: token})
+	if err != nil {
+		return nil, err
+	}
+	return rl.quota(ctx, ident)
+}
+
+func (rl *RateLimiter) quota(ctx context.Context, ident identity) (*QuotaStatus, error) {
+	if ident.quota.Limit <= 0 {
+		return nil, nil
+	}
+
+	key, start, end := quotaKey(ident, time.Now())
+	used, err := rl.storage.GetCount(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quota counter: %w", err)
+	}
+	return newQuotaStatus(ident.quota, used, start, end), nil
+}
+
+// consumeQuota counts a request of the given cost against the identity's
+// quota.
+func (rl *RateLimiter) consumeQuota(ctx context.Context, ident identity, cost int) (*QuotaStatus, error) {
+	now := time.Now()
+	key, start, end := quotaKey(ident, now)
+	used, err := rl.storage.IncrementBy(ctx, key, cost, end.Sub(now))
+	if err != nil {
+		return nil, fmt.Errorf("failed to increment quota counter: %w", err)
+	}
+	return newQuotaStatus(ident.quota, used, start, end), nil
+}
+
+// quotaKey names the counter of the quota period containing now and returns
+// that period's bounds.
+func quotaKey(ident identity, now time.Time) (string, time.Time, time.Time) {
+	start, end := quotaPeriod(now, ident.quota.Period, ident.quotaLocation)
+	return fmt.Sprintf("quota:%s:%s", ident.key, start.Format("2006-01-02")), start, end
+}
+
+func newQuotaStatus(quota config.Quota, used int, start, end time.Time) *QuotaStatus {
+	remaining := quota.Limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &QuotaStatus{
+		Limit:     quota.Limit,
+		Used:      used,
+		Remaining: remaining,
+		Period:    quota.Period,
+		ResetTime: end,
+	}
+}
+
+// quotaPeriod returns the calendar day or month containing now in loc. Both
+// bounds are midnight in loc, so daylight saving changes shift them with the
+// wall clock.
+func quotaPeriod(now time.Time, period string, loc *time.Location) (time.Time, time.Time) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	now = now.In(loc)
+
+	if period == QuotaPeriodMonth {
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	}
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
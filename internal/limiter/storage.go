@@ -7,8 +7,45 @@ import (
 
 type StorageStrategy interface {
 	Increment(ctx context.Context, key string, window time.Duration) (int, error)
+	// IncrementBy adds n to the counter stored under key, starting a new
+	// counter expiring after window if there is none, and returns the result.
+	IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error)
+	// GetCount returns the current value of a counter created by Increment,
+	// or 0 if it does not exist or has expired.
+	GetCount(ctx context.Context, key string) (int, error)
 	SetBan(ctx context.Context, key string, duration time.Duration) error
 	IsBanned(ctx context.Context, key string) (bool, error)
 	GetBanReset(ctx context.Context, key string) (time.Duration, error)
+	// TakeTokens refills the bucket stored under key at refillRate tokens per
+	// second up to capacity and removes n tokens from it if available. It
+	// reports whether the tokens were taken and how many tokens are left.
+	TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error)
+	// LogRequest drops entries older than window from the request log stored
+	// under key and records the current request as n entries if that keeps
+	// the log within limit. It reports whether the request was recorded, how
+	// many entries the log holds and when the oldest of them was recorded.
+	LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error)
+	// GetTAT returns the theoretical arrival time stored under key, or the
+	// zero time if there is none.
+	GetTAT(ctx context.Context, key string) (time.Time, error)
+	// CompareAndSetTAT replaces the theoretical arrival time stored under key
+	// with tat, expiring after ttl, but only if it still equals old. A zero
+	// old time matches a missing key. It reports whether the value was set.
+	CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error)
+	// AcquireLease grants the lease id in the set stored under key if fewer
+	// than limit unexpired leases are held, or renews it if it is held already.
+	// Leases expire after ttl unless renewed. It reports whether the lease is
+	// held and how many leases are active.
+	AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error)
+	// ReleaseLease gives the lease id in the set stored under key back.
+	ReleaseLease(ctx context.Context, key, id string) error
+	// SetOverride stores override under key until its ExpiresAt, replacing
+	// any override stored there.
+	SetOverride(ctx context.Context, key string, override Override) error
+	// GetOverride returns the override stored under key, or nil if there is
+	// none or it has expired.
+	GetOverride(ctx context.Context, key string) (*Override, error)
+	// DeleteOverride removes the override stored under key, if any.
+	DeleteOverride(ctx context.Context, key string) error
 	Close() error
 }
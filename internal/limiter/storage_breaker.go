@@ -0,0 +1,294 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrStorageUnavailable is returned instead of calling a storage whose circuit
+// breaker is open.
+var ErrStorageUnavailable = errors.New("rate limit storage unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreakerStorage guards a storage against being hammered while it is
+// down. After threshold consecutive failures the circuit opens and calls fail
+// straight away with ErrStorageUnavailable, or go to the fallback storage if
+// there is one. Once cooldown has passed a single call is let through to probe
+// the storage, closing the circuit again if it succeeds.
+type CircuitBreakerStorage struct {
+	primary   StorageStrategy
+	fallback  StorageStrategy
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreakerStorage wraps primary in a circuit breaker. fallback may be
+// nil.
+func NewCircuitBreakerStorage(primary, fallback StorageStrategy, threshold int, cooldown time.Duration) *CircuitBreakerStorage {
+	return &CircuitBreakerStorage{
+		primary:   primary,
+		fallback:  fallback,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// do runs fn against the primary storage if the circuit lets it through and
+// against the fallback otherwise, or when the primary fails.
+func (b *CircuitBreakerStorage) do(ctx context.Context, fn func(s StorageStrategy) error) error {
+	if !b.acquire() {
+		if b.fallback != nil {
+			return fn(b.fallback)
+		}
+		return ErrStorageUnavailable
+	}
+
+	err := fn(b.primary)
+	// A request given up by its client says nothing about the storage.
+	if err != nil && ctx.Err() != nil {
+		b.release()
+		return err
+	}
+	b.record(err)
+
+	if err != nil && b.fallback != nil {
+		log.Printf("[Breaker] Storage call failed, using fallback: %v", err)
+		return fn(b.fallback)
+	}
+	return err
+}
+
+// acquire reports whether a call may go to the primary storage.
+func (b *CircuitBreakerStorage) acquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight.
+		return false
+	default:
+		return true
+	}
+}
+
+// release gives back a call that neither succeeded nor failed.
+func (b *CircuitBreakerStorage) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+func (b *CircuitBreakerStorage) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Printf("[Breaker] Storage recovered, circuit closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Printf("[Breaker] Storage failing, circuit opened for %v: %v", b.cooldown, err)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *CircuitBreakerStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	return b.IncrementBy(ctx, key, 1, window)
+}
+
+func (b *CircuitBreakerStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	var count int
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		count, err = s.IncrementBy(ctx, key, n, window)
+		return err
+	})
+	return count, err
+}
+
+func (b *CircuitBreakerStorage) GetCount(ctx context.Context, key string) (int, error) {
+	var count int
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		count, err = s.GetCount(ctx, key)
+		return err
+	})
+	return count, err
+}
+
+func (b *CircuitBreakerStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
+	return b.do(ctx, func(s StorageStrategy) error {
+		return s.SetBan(ctx, key, duration)
+	})
+}
+
+func (b *CircuitBreakerStorage) IsBanned(ctx context.Context, key string) (bool, error) {
+	var banned bool
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		banned, err = s.IsBanned(ctx, key)
+		return err
+	})
+	return banned, err
+}
+
+func (b *CircuitBreakerStorage) GetBanReset(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		ttl, err = s.GetBanReset(ctx, key)
+		return err
+	})
+	return ttl, err
+}
+
+func (b *CircuitBreakerStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	var (
+		allowed bool
+		tokens  float64
+	)
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		allowed, tokens, err = s.TakeTokens(ctx, key, n, capacity, refillRate)
+		return err
+	})
+	return allowed, tokens, err
+}
+
+func (b *CircuitBreakerStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	var (
+		allowed bool
+		count   int
+		oldest  time.Time
+	)
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		allowed, count, oldest, err = s.LogRequest(ctx, key, n, limit, window)
+		return err
+	})
+	return allowed, count, oldest, err
+}
+
+func (b *CircuitBreakerStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	var tat time.Time
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		tat, err = s.GetTAT(ctx, key)
+		return err
+	})
+	return tat, err
+}
+
+func (b *CircuitBreakerStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	var swapped bool
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		swapped, err = s.CompareAndSetTAT(ctx, key, old, tat, ttl)
+		return err
+	})
+	return swapped, err
+}
+
+func (b *CircuitBreakerStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	var (
+		acquired bool
+		count    int
+	)
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		acquired, count, err = s.AcquireLease(ctx, key, id, limit, ttl)
+		return err
+	})
+	return acquired, count, err
+}
+
+func (b *CircuitBreakerStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	return b.do(ctx, func(s StorageStrategy) error {
+		return s.ReleaseLease(ctx, key, id)
+	})
+}
+
+func (b *CircuitBreakerStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	return b.do(ctx, func(s StorageStrategy) error {
+		return s.SetOverride(ctx, key, override)
+	})
+}
+
+func (b *CircuitBreakerStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	var override *Override
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		override, err = s.GetOverride(ctx, key)
+		return err
+	})
+	return override, err
+}
+
+func (b *CircuitBreakerStorage) DeleteOverride(ctx context.Context, key string) error {
+	return b.do(ctx, func(s StorageStrategy) error {
+		return s.DeleteOverride(ctx, key)
+	})
+}
+
+// CheckWindows keeps the single round trip path of a primary storage
+// supporting it. Storages without one, the fallback included, get the same
+// decision from their plain operations.
+func (b *CircuitBreakerStorage) CheckWindows(ctx context.Context, banKey string, windows []WindowCheck, cost int, blockDuration time.Duration) (*WindowCheckResult, error) {
+	var result *WindowCheckResult
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		if checker, ok := s.(WindowChecker); ok {
+			result, err = checker.CheckWindows(ctx, banKey, windows, cost, blockDuration)
+		} else {
+			result, err = checkWindowsWith(ctx, s, banKey, windows, cost, blockDuration)
+		}
+		return err
+	})
+	return result, err
+}
+
+// TokenTier looks the tier of token up in a primary storage holding token
+// tiers. Storages without them, the fallback included, know of no tier.
+func (b *CircuitBreakerStorage) TokenTier(ctx context.Context, token string) (string, error) {
+	var tier string
+	err := b.do(ctx, func(s StorageStrategy) (err error) {
+		if store, ok := s.(TokenTierStore); ok {
+			tier, err = store.TokenTier(ctx, token)
+		}
+		return err
+	})
+	return tier, err
+}
+
+func (b *CircuitBreakerStorage) Close() error {
+	err := b.primary.Close()
+	if b.fallback != nil {
+		if fallbackErr := b.fallback.Close(); err == nil {
+			err = fallbackErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,271 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter/storagetest"
+)
+
+// The backends needing a server are only tested against a live one, named by
+// these variables. Their tests are skipped when they are not set.
+const (
+	redisTestURLEnv      = "REDIS_TEST_URL"
+	memcachedTestAddrEnv = "MEMCACHED_TEST_SERVER"
+	mysqlTestDSNEnv      = "MYSQL_TEST_DSN"
+	postgresTestDSNEnv   = "POSTGRES_TEST_DSN"
+)
+
+func testEnv(t *testing.T, name string) string {
+	t.Helper()
+	value := os.Getenv(name)
+	if value == "" {
+		t.Skipf("%s not set", name)
+	}
+	return value
+}
+
+func newMemoryStorage(t *testing.T) limiter.StorageStrategy {
+	storage, err := limiter.NewMemoryStorage(1000, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func newSQLiteStorage(t *testing.T) *limiter.SQLiteStorage {
+	storage, err := limiter.NewSQLiteStorage(filepath.Join(t.TempDir(), "rate_limiter.db"), true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func newRedisStorage(t *testing.T) *limiter.RedisStorage {
+	storage, err := limiter.NewRedisStorage(testEnv(t, redisTestURLEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func newMySQLStorage(t *testing.T) *limiter.MySQLStorage {
+	storage, err := limiter.NewMySQLStorage(testEnv(t, mysqlTestDSNEnv), true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func newPostgresStorage(t *testing.T) *limiter.PostgresStorage {
+	storage, err := limiter.NewPostgresStorage(testEnv(t, postgresTestDSNEnv), true, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	t.Parallel()
+	storagetest.Run(t, newMemoryStorage)
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy { return newSQLiteStorage(t) })
+}
+
+func TestRedisStorageConformance(t *testing.T) {
+	testEnv(t, redisTestURLEnv)
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy { return newRedisStorage(t) })
+}
+
+func TestMemcachedStorageConformance(t *testing.T) {
+	addr := testEnv(t, memcachedTestAddrEnv)
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy {
+		storage, err := limiter.NewMemcachedStorage([]string{addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	})
+}
+
+func TestMySQLStorageConformance(t *testing.T) {
+	testEnv(t, mysqlTestDSNEnv)
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy { return newMySQLStorage(t) })
+}
+
+func TestPostgresStorageConformance(t *testing.T) {
+	testEnv(t, postgresTestDSNEnv)
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy { return newPostgresStorage(t) })
+}
+
+func TestCircuitBreakerStorageConformance(t *testing.T) {
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy {
+		return limiter.NewCircuitBreakerStorage(newMemoryStorage(t), nil, 5, time.Second)
+	})
+}
+
+// The local cache is only exact when every increment is synced.
+func TestTieredStorageConformance(t *testing.T) {
+	t.Parallel()
+	storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy {
+		return limiter.NewTieredStorage(newMemoryStorage(t), 100*time.Millisecond, 1)
+	})
+}
+
+// TestTieredStorageExpiry checks that a counter cached between syncs starts
+// over once its window is gone, without losing the increments not synced yet.
+func TestTieredStorageExpiry(t *testing.T) {
+	ctx := context.Background()
+	remote := &countingStorage{StorageStrategy: newMemoryStorage(t)}
+	storage := limiter.NewTieredStorage(remote, time.Minute, 10)
+	t.Cleanup(func() { _ = storage.Close() })
+
+	increment := func(want int) {
+		t.Helper()
+		if count, err := storage.IncrementBy(ctx, "k", 1, 50*time.Millisecond); err != nil || count != want {
+			t.Fatalf("IncrementBy = %d, %v; want %d", count, err, want)
+		}
+	}
+
+	increment(1)
+	time.Sleep(100 * time.Millisecond)
+	increment(1)
+
+	// This one stays local until the counter expires.
+	increment(2)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := storage.IncrementBy(ctx, "k", 1, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if remote.pushed != 4 {
+		t.Errorf("increments pushed = %d, want 4", remote.pushed)
+	}
+}
+
+// countingStorage adds up the increments pushed to a storage.
+type countingStorage struct {
+	limiter.StorageStrategy
+	pushed int
+}
+
+func (s *countingStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	s.pushed += n
+	return s.StorageStrategy.IncrementBy(ctx, key, n, window)
+}
+
+func TestUnavailableStorage(t *testing.T) {
+	closed := func(storage limiter.StorageStrategy) limiter.StorageStrategy {
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+
+	tests := []struct {
+		name       string
+		newStorage func(t *testing.T) limiter.StorageStrategy
+	}{
+		{"SQLite", func(t *testing.T) limiter.StorageStrategy { return closed(newSQLiteStorage(t)) }},
+		{"Redis", func(t *testing.T) limiter.StorageStrategy { return closed(newRedisStorage(t)) }},
+		{"MySQL", func(t *testing.T) limiter.StorageStrategy { return closed(newMySQLStorage(t)) }},
+		{"Postgres", func(t *testing.T) limiter.StorageStrategy { return closed(newPostgresStorage(t)) }},
+		{"CircuitBreaker", func(t *testing.T) limiter.StorageStrategy {
+			return limiter.NewCircuitBreakerStorage(failingStorage{}, nil, 5, time.Second)
+		}},
+		{"Tiered", func(t *testing.T) limiter.StorageStrategy {
+			return limiter.NewTieredStorage(failingStorage{}, 100*time.Millisecond, 10)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storagetest.RunUnavailable(t, tt.newStorage(t))
+		})
+	}
+}
+
+var errUnavailable = errors.New("storage unavailable")
+
+// failingStorage is a storage whose every operation fails, for checking that
+// the storage decorators pass errors on.
+type failingStorage struct{}
+
+func (failingStorage) Increment(context.Context, string, time.Duration) (int, error) {
+	return 0, errUnavailable
+}
+
+func (failingStorage) IncrementBy(context.Context, string, int, time.Duration) (int, error) {
+	return 0, errUnavailable
+}
+
+func (failingStorage) GetCount(context.Context, string) (int, error) {
+	return 0, errUnavailable
+}
+
+func (failingStorage) SetBan(context.Context, string, time.Duration) error {
+	return errUnavailable
+}
+
+func (failingStorage) IsBanned(context.Context, string) (bool, error) {
+	return false, errUnavailable
+}
+
+func (failingStorage) GetBanReset(context.Context, string) (time.Duration, error) {
+	return 0, errUnavailable
+}
+
+func (failingStorage) TakeTokens(context.Context, string, int, int, float64) (bool, float64, error) {
+	return false, 0, errUnavailable
+}
+
+func (failingStorage) LogRequest(context.Context, string, int, int, time.Duration) (bool, int, time.Time, error) {
+	return false, 0, time.Time{}, errUnavailable
+}
+
+func (failingStorage) GetTAT(context.Context, string) (time.Time, error) {
+	return time.Time{}, errUnavailable
+}
+
+func (failingStorage) CompareAndSetTAT(context.Context, string, time.Time, time.Time, time.Duration) (bool, error) {
+	return false, errUnavailable
+}
+
+func (failingStorage) AcquireLease(context.Context, string, string, int, time.Duration) (bool, int, error) {
+	return false, 0, errUnavailable
+}
+
+func (failingStorage) ReleaseLease(context.Context, string, string) error {
+	return errUnavailable
+}
+
+func (failingStorage) SetOverride(context.Context, string, limiter.Override) error {
+	return errUnavailable
+}
+
+func (failingStorage) GetOverride(context.Context, string) (*limiter.Override, error) {
+	return nil, errUnavailable
+}
+
+func (failingStorage) DeleteOverride(context.Context, string) error {
+	return errUnavailable
+}
+
+func (failingStorage) Close() error {
+	return nil
+}
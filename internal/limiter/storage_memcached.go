@@ -7,9 +7,14 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 	"log"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// memcachedCASAttempts bounds how often an optimistic update is retried when
+// other clients keep changing the same key.
+const memcachedCASAttempts = 10
+
 type MemcachedStorage struct {
 	client *memcache.Client
 }
@@ -23,20 +28,25 @@ func NewMemcachedStorage(servers []string) (*MemcachedStorage, error) {
 	if err := client.Set(&memcache.Item{Key: "__ping__", Value: []byte("1"), Expiration: 1}); err != nil {
 		return nil, fmt.Errorf("failed connecting to memcached: %w", err)
 	}
+	log.Printf("[Memcached] Using Memcached storage strategy")
 	return &MemcachedStorage{client: client}, nil
 }
 
 func (m *MemcachedStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
-	newVal, err := m.client.Increment(key, 1)
+	return m.IncrementBy(ctx, key, 1, window)
+}
+
+func (m *MemcachedStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	newVal, err := m.client.Increment(key, uint64(n))
 	if err == memcache.ErrCacheMiss {
 		item := &memcache.Item{
 			Key:        key,
-			Value:      []byte("1"),
-			Expiration: int32(window.Seconds()),
+			Value:      []byte(strconv.Itoa(n)),
+			Expiration: memcachedExpiration(window),
 		}
 		if addErr := m.client.Add(item); addErr != nil {
 			if addErr == memcache.ErrNotStored {
-				newVal, err = m.client.Increment(key, 1)
+				newVal, err = m.client.Increment(key, uint64(n))
 				if err != nil {
 					return 0, fmt.Errorf("increment failed after add: %w", err)
 				}
@@ -44,20 +54,35 @@ func (m *MemcachedStorage) Increment(ctx context.Context, key string, window tim
 			}
 			return 0, fmt.Errorf("failed adding key: %w", addErr)
 		}
-		return 1, nil
+		return n, nil
 	} else if err != nil {
 		return 0, fmt.Errorf("failed incrementing key: %w", err)
 	}
-	_ = m.client.Touch(key, int32(window.Seconds()))
+	_ = m.client.Touch(key, memcachedExpiration(window))
 	return int(newVal), nil
 }
 
+func (m *MemcachedStorage) GetCount(ctx context.Context, key string) (int, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed getting counter: %w", err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(item.Value)))
+	if err != nil {
+		return 0, fmt.Errorf("failed parsing counter: %w", err)
+	}
+	return count, nil
+}
+
 func (m *MemcachedStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
 	expiresAt := time.Now().Add(duration).Unix()
 	item := &memcache.Item{
 		Key:        key,
 		Value:      []byte(strconv.FormatInt(expiresAt, 10)),
-		Expiration: int32(duration.Seconds()),
+		Expiration: memcachedExpiration(duration),
 	}
 	if err := m.client.Set(item); err != nil {
 		return fmt.Errorf("failed set ban: %w", err)
@@ -80,7 +105,6 @@ func (m *MemcachedStorage) IsBanned(ctx context.Context, key string) (bool, erro
 	if time.Now().After(time.Unix(ts, 0)) {
 		return false, nil
 	}
-	log.Printf("[Memcached] Using Memcached storage strategy")
 	return true, nil
 }
 
@@ -103,6 +127,307 @@ func (m *MemcachedStorage) GetBanReset(ctx context.Context, key string) (time.Du
 	return ttl, nil
 }
 
+func (m *MemcachedStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	var (
+		allowed bool
+		tokens  float64
+	)
+	err := m.update(key, bucketTTL(capacity, refillRate), func(value []byte) ([]byte, error) {
+		now := time.Now()
+		tokens, updatedAt := float64(capacity), now
+		if value != nil {
+			parts := strings.SplitN(string(value), "|", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid token bucket state: %q", value)
+			}
+			t, err := strconv.ParseFloat(parts[0], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed parsing token count: %w", err)
+			}
+			ms, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed parsing bucket timestamp: %w", err)
+			}
+			tokens, updatedAt = t, time.UnixMilli(ms)
+		}
+		allowed, tokens = takeFromBucket(tokens, updatedAt, now, n, capacity, refillRate)
+		return []byte(strconv.FormatFloat(tokens, 'f', -1, 64) + "|" + strconv.FormatInt(now.UnixMilli(), 10)), nil
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed taking token: %w", err)
+	}
+	return allowed, tokens, nil
+}
+
+func (m *MemcachedStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	var (
+		allowed bool
+		entries []time.Time
+	)
+	err := m.update(key, window, func(value []byte) ([]byte, error) {
+		now := time.Now()
+		entries = entries[:0]
+		for _, field := range strings.Fields(string(value)) {
+			us, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed parsing request timestamp: %w", err)
+			}
+			entries = append(entries, time.UnixMicro(us))
+		}
+		allowed, entries = trimLog(entries, now, n, limit, window)
+
+		fields := make([]string, len(entries))
+		for i, ts := range entries {
+			fields[i] = strconv.FormatInt(ts.UnixMicro(), 10)
+		}
+		return []byte(strings.Join(fields, " ")), nil
+	})
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("failed logging request: %w", err)
+	}
+
+	oldest := time.Now()
+	if len(entries) > 0 {
+		oldest = entries[0]
+	}
+	return allowed, len(entries), oldest, nil
+}
+
+func (m *MemcachedStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed getting arrival time: %w", err)
+	}
+	nanos, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed parsing arrival time: %w", err)
+	}
+	return tatFromNanos(nanos), nil
+}
+
+func (m *MemcachedStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	value := []byte(strconv.FormatInt(tatNanos(tat), 10))
+
+	if old.IsZero() {
+		err := m.client.Add(&memcache.Item{Key: key, Value: value, Expiration: memcachedExpiration(ttl)})
+		if errors.Is(err, memcache.ErrNotStored) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed setting arrival time: %w", err)
+		}
+		return true, nil
+	}
+
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed getting arrival time: %w", err)
+	}
+	if string(item.Value) != strconv.FormatInt(tatNanos(old), 10) {
+		return false, nil
+	}
+
+	item.Value = value
+	item.Expiration = memcachedExpiration(ttl)
+	err = m.client.CompareAndSwap(item)
+	if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed setting arrival time: %w", err)
+	}
+	return true, nil
+}
+
+func (m *MemcachedStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	var (
+		acquired bool
+		count    int
+	)
+	err := m.update(key, ttl, func(value []byte) ([]byte, error) {
+		leases, err := parseLeases(value)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for leaseID, expiresAt := range leases {
+			if !expiresAt.After(now) {
+				delete(leases, leaseID)
+			}
+		}
+
+		_, held := leases[id]
+		acquired = held || len(leases) < limit
+		if acquired {
+			leases[id] = now.Add(ttl)
+		}
+		count = len(leases)
+		return formatLeases(leases), nil
+	})
+	if err != nil {
+		return false, 0, fmt.Errorf("failed acquiring lease: %w", err)
+	}
+	return acquired, count, nil
+}
+
+func (m *MemcachedStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed releasing lease: %w", err)
+	}
+
+	// Keep the remaining leases' own expiry instead of extending it.
+	var ttl time.Duration
+	if leases, err := parseLeases(item.Value); err == nil {
+		for _, expiresAt := range leases {
+			if d := time.Until(expiresAt); d > ttl {
+				ttl = d
+			}
+		}
+	}
+
+	err = m.update(key, ttl, func(value []byte) ([]byte, error) {
+		leases, err := parseLeases(value)
+		if err != nil {
+			return nil, err
+		}
+		delete(leases, id)
+		return formatLeases(leases), nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed releasing lease: %w", err)
+	}
+	return nil
+}
+
+func (m *MemcachedStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	item := &memcache.Item{
+		Key:        key,
+		Value:      formatOverride(override),
+		Expiration: memcachedExpiration(time.Until(override.ExpiresAt)),
+	}
+	if err := m.client.Set(item); err != nil {
+		return fmt.Errorf("failed setting override: %w", err)
+	}
+	return nil
+}
+
+// GetOverride checks the expiry stored with the override, since memcached
+// only expires items to the second.
+func (m *MemcachedStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	item, err := m.client.Get(key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting override: %w", err)
+	}
+	override, err := parseOverride(item.Value)
+	if err != nil {
+		return nil, err
+	}
+	if !override.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return override, nil
+}
+
+func (m *MemcachedStorage) DeleteOverride(ctx context.Context, key string) error {
+	err := m.client.Delete(key)
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) {
+		return fmt.Errorf("failed deleting override: %w", err)
+	}
+	return nil
+}
+
+// parseLeases decodes space-separated id=expiry pairs, expiry being unix
+// milliseconds.
+func parseLeases(value []byte) (map[string]time.Time, error) {
+	leases := make(map[string]time.Time)
+	for _, field := range strings.Fields(string(value)) {
+		id, msStr, found := strings.Cut(field, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid lease: %q", field)
+		}
+		ms, err := strconv.ParseInt(msStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing lease expiry: %w", err)
+		}
+		leases[id] = time.UnixMilli(ms)
+	}
+	return leases, nil
+}
+
+func formatLeases(leases map[string]time.Time) []byte {
+	fields := make([]string, 0, len(leases))
+	for id, expiresAt := range leases {
+		fields = append(fields, id+"="+strconv.FormatInt(expiresAt.UnixMilli(), 10))
+	}
+	return []byte(strings.Join(fields, " "))
+}
+
+// update applies fn to the current value of key and stores the result with
+// compare-and-swap, retrying when another client changed the key in between.
+// A missing key is passed to fn as nil.
+func (m *MemcachedStorage) update(key string, ttl time.Duration, fn func(value []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < memcachedCASAttempts; attempt++ {
+		item, err := m.client.Get(key)
+		if errors.Is(err, memcache.ErrCacheMiss) {
+			value, err := fn(nil)
+			if err != nil {
+				return err
+			}
+			err = m.client.Add(&memcache.Item{Key: key, Value: value, Expiration: memcachedExpiration(ttl)})
+			if errors.Is(err, memcache.ErrNotStored) {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		item.Value, err = fn(item.Value)
+		if err != nil {
+			return err
+		}
+		item.Expiration = memcachedExpiration(ttl)
+		err = m.client.CompareAndSwap(item)
+		if errors.Is(err, memcache.ErrCASConflict) || errors.Is(err, memcache.ErrNotStored) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("too many concurrent updates of %s", key)
+}
+
+// memcachedMaxRelativeExpiration is the longest expiration memcached accepts
+// in seconds; larger values are read as absolute Unix timestamps.
+const memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+// memcachedExpiration converts ttl to whole seconds, rounding up so that short
+// windows never turn into 0, which memcached treats as "never expire". TTLs
+// beyond 30 days are sent as the absolute time they end at.
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl > memcachedMaxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	seconds := int32((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
 func (m *MemcachedStorage) Close() error {
 	return nil
 }
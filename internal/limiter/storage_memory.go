@@ -0,0 +1,355 @@
+package limiter
+
+import (
+	"context"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// memoryShardCount is the number of independently locked shards keys are
+	// spread over, so that concurrent requests for different keys rarely
+	// contend on the same lock.
+	memoryShardCount = 64
+
+	// memoryEvictionSample is how many entries are looked at to pick one to
+	// evict when a shard is full.
+	memoryEvictionSample = 8
+)
+
+type memoryEntry struct {
+	value     any
+	expiresAt time.Time
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+type memoryShard struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+// MemoryStorage keeps all state in process. It suits single-instance
+// deployments and tests; nothing is shared between replicas or survives a
+// restart.
+type MemoryStorage struct {
+	shards         [memoryShardCount]*memoryShard
+	maxKeysInShard int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewMemoryStorage creates an in-memory storage holding at most maxKeys keys
+// and sweeping expired ones every cleanupInterval.
+func NewMemoryStorage(maxKeys int, cleanupInterval time.Duration) (*MemoryStorage, error) {
+	maxKeysInShard := maxKeys / memoryShardCount
+	if maxKeysInShard < 1 {
+		maxKeysInShard = 1
+	}
+
+	m := &MemoryStorage{
+		maxKeysInShard: maxKeysInShard,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	for i := range m.shards {
+		m.shards[i] = &memoryShard{entries: make(map[string]*memoryEntry)}
+	}
+
+	go m.cleanup(cleanupInterval)
+	log.Printf("[Memory] Using in-memory storage strategy")
+	return m, nil
+}
+
+func (m *MemoryStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	return m.IncrementBy(ctx, key, 1, window)
+}
+
+func (m *MemoryStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	var count int
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		entry := shard.get(key, now)
+		if current, ok := entryValue[int](entry); ok {
+			count = current + n
+		} else {
+			count = n
+		}
+		m.put(shard, key, count, now.Add(window))
+	})
+	return count, nil
+}
+
+func (m *MemoryStorage) GetCount(ctx context.Context, key string) (int, error) {
+	var count int
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		count, _ = entryValue[int](shard.get(key, now))
+	})
+	return count, nil
+}
+
+func (m *MemoryStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		m.put(shard, key, true, now.Add(duration))
+	})
+	return nil
+}
+
+func (m *MemoryStorage) IsBanned(ctx context.Context, key string) (bool, error) {
+	var banned bool
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		banned = shard.get(key, now) != nil
+	})
+	return banned, nil
+}
+
+func (m *MemoryStorage) GetBanReset(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		if entry := shard.get(key, now); entry != nil {
+			ttl = entry.expiresAt.Sub(now)
+		}
+	})
+	return ttl, nil
+}
+
+func (m *MemoryStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	var (
+		allowed bool
+		tokens  float64
+	)
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		bucket, ok := entryValue[memoryBucket](shard.get(key, now))
+		if !ok {
+			bucket = memoryBucket{tokens: float64(capacity), updatedAt: now}
+		}
+		allowed, tokens = takeFromBucket(bucket.tokens, bucket.updatedAt, now, n, capacity, refillRate)
+		m.put(shard, key, memoryBucket{tokens: tokens, updatedAt: now}, now.Add(bucketTTL(capacity, refillRate)))
+	})
+	return allowed, tokens, nil
+}
+
+func (m *MemoryStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	var (
+		allowed bool
+		entries []time.Time
+		oldest  time.Time
+	)
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		entries, _ = entryValue[[]time.Time](shard.get(key, now))
+		allowed, entries = trimLog(entries, now, n, limit, window)
+		m.put(shard, key, entries, now.Add(window))
+
+		oldest = now
+		if len(entries) > 0 {
+			oldest = entries[0]
+		}
+	})
+	return allowed, len(entries), oldest, nil
+}
+
+func (m *MemoryStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	var tat time.Time
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		tat, _ = entryValue[time.Time](shard.get(key, now))
+	})
+	return tat, nil
+}
+
+func (m *MemoryStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	var swapped bool
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		current, _ := entryValue[time.Time](shard.get(key, now))
+		if !current.Equal(old) {
+			return
+		}
+		m.put(shard, key, tat, now.Add(ttl))
+		swapped = true
+	})
+	return swapped, nil
+}
+
+func (m *MemoryStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	var (
+		acquired bool
+		count    int
+	)
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		leases, ok := entryValue[map[string]time.Time](shard.get(key, now))
+		if !ok {
+			leases = make(map[string]time.Time)
+		}
+		for leaseID, expiresAt := range leases {
+			if !expiresAt.After(now) {
+				delete(leases, leaseID)
+			}
+		}
+
+		_, held := leases[id]
+		acquired = held || len(leases) < limit
+		if acquired {
+			leases[id] = now.Add(ttl)
+		}
+		count = len(leases)
+		m.put(shard, key, leases, latestExpiry(leases, now))
+	})
+	return acquired, count, nil
+}
+
+func (m *MemoryStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		leases, ok := entryValue[map[string]time.Time](shard.get(key, now))
+		if !ok {
+			return
+		}
+		delete(leases, id)
+		if len(leases) == 0 {
+			delete(shard.entries, key)
+		}
+	})
+	return nil
+}
+
+func (m *MemoryStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		m.put(shard, key, override, override.ExpiresAt)
+	})
+	return nil
+}
+
+func (m *MemoryStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	var result *Override
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		if override, ok := entryValue[Override](shard.get(key, now)); ok {
+			result = &override
+		}
+	})
+	return result, nil
+}
+
+func (m *MemoryStorage) DeleteOverride(ctx context.Context, key string) error {
+	m.with(key, func(shard *memoryShard, now time.Time) {
+		delete(shard.entries, key)
+	})
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+	<-m.done
+	return nil
+}
+
+// with runs fn with the shard owning key locked.
+func (m *MemoryStorage) with(key string, fn func(shard *memoryShard, now time.Time)) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	shard := m.shards[h.Sum32()%memoryShardCount]
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	fn(shard, time.Now())
+}
+
+// put stores value under key, evicting another entry first if the shard is
+// full. The caller must hold the shard's lock.
+func (m *MemoryStorage) put(shard *memoryShard, key string, value any, expiresAt time.Time) {
+	if entry, ok := shard.entries[key]; ok {
+		entry.value = value
+		entry.expiresAt = expiresAt
+		return
+	}
+	if len(shard.entries) >= m.maxKeysInShard {
+		shard.evict()
+	}
+	shard.entries[key] = &memoryEntry{value: value, expiresAt: expiresAt}
+}
+
+// get returns the unexpired entry stored under key, or nil. The caller must
+// hold the shard's lock.
+func (s *memoryShard) get(key string, now time.Time) *memoryEntry {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expiresAt.After(now) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+// evict drops the entry closest to expiry among a small sample, which
+// approximates dropping the least valuable state without scanning the shard.
+func (s *memoryShard) evict() {
+	var (
+		victim   string
+		earliest time.Time
+		sampled  int
+	)
+	for key, entry := range s.entries {
+		if sampled == 0 || entry.expiresAt.Before(earliest) {
+			victim, earliest = key, entry.expiresAt
+		}
+		sampled++
+		if sampled == memoryEvictionSample {
+			break
+		}
+	}
+	delete(s.entries, victim)
+}
+
+// cleanup sweeps expired entries until Close is called.
+func (m *MemoryStorage) cleanup(interval time.Duration) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			for _, shard := range m.shards {
+				shard.mu.Lock()
+				now := time.Now()
+				for key, entry := range shard.entries {
+					if !entry.expiresAt.After(now) {
+						delete(shard.entries, key)
+					}
+				}
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// entryValue returns the value of entry if it is a T.
+func entryValue[T any](entry *memoryEntry) (T, bool) {
+	var zero T
+	if entry == nil {
+		return zero, false
+	}
+	value, ok := entry.value.(T)
+	return value, ok
+}
+
+func latestExpiry(leases map[string]time.Time, now time.Time) time.Time {
+	latest := now
+	for _, expiresAt := range leases {
+		if expiresAt.After(latest) {
+			latest = expiresAt
+		}
+	}
+	return latest
+}
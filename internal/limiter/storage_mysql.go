@@ -11,10 +11,32 @@ import (
 )
 
 type MySQLStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	janitor *janitor
 }
 
-func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
+// NewMySQLStorage connects to the MySQL database at dsn and applies pending
+// schema migrations if autoMigrate is set. Unless cleanupInterval is zero,
+// expired rows are deleted every cleanupInterval, at most cleanupBatchSize
+// rows per statement.
+func NewMySQLStorage(dsn string, autoMigrate bool, cleanupInterval time.Duration, cleanupBatchSize int) (*MySQLStorage, error) {
+	db, err := openMySQL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(context.Background(), db, mysqlDialect, autoMigrate); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[MySQL] Using MySQL storage strategy")
+	m := &MySQLStorage{db: db}
+	if cleanupInterval > 0 {
+		m.janitor = startJanitor("MySQL", cleanupInterval, cleanupBatchSize, m.janitorTasks())
+	}
+	return m, nil
+}
+
+func openMySQL(dsn string) (*sql.DB, error) {
 	if !strings.Contains(dsn, "parseTime=") {
 		if strings.Contains(dsn, "?") {
 			dsn += "&parseTime=true"
@@ -27,55 +49,77 @@ func NewMySQLStorage(dsn string) (*MySQLStorage, error) {
 		return nil, fmt.Errorf("failed connecting to MySQL: %w", err)
 	}
 	if err := db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, fmt.Errorf("failed pinging MySQL: %w", err)
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS rate_limits (k VARCHAR(255) PRIMARY KEY, count INT NOT NULL, expires_at TIMESTAMP)`); err != nil {
-		return nil, fmt.Errorf("create table rate_limits: %w", err)
+	return db, nil
+}
+
+func (m *MySQLStorage) janitorTasks() []janitorTask {
+	expired := func(table string) janitorTask {
+		return janitorTask{table: table, deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, m.db, `DELETE FROM `+table+` WHERE expires_at < ? LIMIT ?`, now, limit)
+		}}
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS bans (k VARCHAR(255) PRIMARY KEY, expires_at TIMESTAMP)`); err != nil {
-		return nil, fmt.Errorf("create table bans: %w", err)
+	return []janitorTask{
+		expired("rate_limits"),
+		expired("bans"),
+		expired("token_buckets"),
+		expired("gcra_tats"),
+		expired("request_logs"),
+		expired("request_log_entries"),
+		expired("lease_sets"),
+		{table: "leases", deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, m.db, `DELETE FROM leases WHERE expires_at < ? LIMIT ?`, now.UnixMilli(), limit)
+		}},
+		{table: "limit_overrides", deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, m.db, `DELETE FROM limit_overrides WHERE expires_at < ? LIMIT ?`, now.UnixMilli(), limit)
+		}},
 	}
-	log.Printf("[MySQL] Using MySQL storage strategy")
-	return &MySQLStorage{db: db}, nil
+}
+
+// CleanupStats reports how many expired rows the janitor has deleted.
+func (m *MySQLStorage) CleanupStats() CleanupStats {
+	return m.janitor.Stats()
 }
 
 func (m *MySQLStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
-	tx, err := m.db.BeginTx(ctx, nil)
+	return m.IncrementBy(ctx, key, 1, window)
+}
+
+func (m *MySQLStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	// MySQL has no RETURNING clause, so the new count is passed back through
+	// LAST_INSERT_ID(expr), which the driver reports as the insert id. The
+	// count is assigned before expires_at so that it still sees the old expiry.
+	now := time.Now()
+	res, err := m.db.ExecContext(ctx, `INSERT INTO rate_limits (k, count, expires_at) VALUES (?, LAST_INSERT_ID(?), ?)
+		ON DUPLICATE KEY UPDATE
+			count = LAST_INSERT_ID(IF(expires_at IS NULL OR expires_at < ?, VALUES(count), count + VALUES(count))),
+			expires_at = VALUES(expires_at)`,
+		key, n, now.Add(window), now)
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		} else {
-			_ = tx.Commit()
-		}
-	}()
-
-	var count int
-	var expiresAt sql.NullTime
-	err = tx.QueryRowContext(ctx, `SELECT count, expires_at FROM rate_limits WHERE k = ? FOR UPDATE`, key).Scan(&count, &expiresAt)
-	if err == sql.ErrNoRows {
-		count = 1
-		expires := time.Now().Add(window)
-		_, err = tx.ExecContext(ctx, `INSERT INTO rate_limits (k, count, expires_at) VALUES (?, ?, ?)`, key, count, expires)
-		return count, err
-	}
+	count, err := res.LastInsertId()
 	if err != nil {
 		return 0, err
 	}
+	return int(count), nil
+}
 
-	now := time.Now()
-	if !expiresAt.Valid || expiresAt.Time.Before(now) {
-		count = 1
-	} else {
-		count++
+func (m *MySQLStorage) GetCount(ctx context.Context, key string) (int, error) {
+	var count int
+	var expiresAt sql.NullTime
+	err := m.db.QueryRowContext(ctx, `SELECT count, expires_at FROM rate_limits WHERE k = ?`, key).Scan(&count, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
 	}
-	expires := now.Add(window)
-	_, err = tx.ExecContext(ctx, `UPDATE rate_limits SET count = ?, expires_at = ? WHERE k = ?`, count, expires, key)
 	if err != nil {
 		return 0, err
 	}
+	if !expiresAt.Valid || expiresAt.Time.Before(time.Now()) {
+		return 0, nil
+	}
 	return count, nil
 }
 
@@ -92,7 +136,7 @@ func (m *MySQLStorage) IsBanned(ctx context.Context, key string) (bool, error) {
 		return false, nil
 	}
 	if err != nil {
-		return false, nil
+		return false, err
 	}
 	if expiresAt.After(time.Now()) {
 		return true, nil
@@ -116,6 +160,211 @@ func (m *MySQLStorage) GetBanReset(ctx context.Context, key string) (time.Durati
 	return ttl, nil
 }
 
+func (m *MySQLStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Make sure the row exists so that concurrent first requests serialize on
+	// the row lock below instead of racing on the insert.
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO token_buckets (k, tokens, updated_at, expires_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE k = k`,
+		key, capacity, start.UnixMilli(), start.Add(bucketTTL(capacity, refillRate)))
+	if err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var updatedAt int64
+	err = tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM token_buckets WHERE k = ? FOR UPDATE`, key).Scan(&tokens, &updatedAt)
+	if err != nil {
+		return false, 0, err
+	}
+
+	now := time.Now()
+	allowed, tokens := takeFromBucket(tokens, time.UnixMilli(updatedAt), now, n, capacity, refillRate)
+	_, err = tx.ExecContext(ctx, `UPDATE token_buckets SET tokens = ?, updated_at = ?, expires_at = ? WHERE k = ?`,
+		tokens, now.UnixMilli(), now.Add(bucketTTL(capacity, refillRate)), key)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+func (m *MySQLStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Upserting the log's head row locks it, which serializes concurrent
+	// requests for the same key for the rest of the transaction.
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO request_logs (k, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at)`, key, start.Add(window))
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `DELETE FROM request_log_entries WHERE k = ? AND ts <= ?`, key, now.Add(-window).UnixMicro())
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	var count int
+	var oldest int64
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MIN(ts), 0) FROM request_log_entries WHERE k = ?`, key).Scan(&count, &oldest)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	allowed := count+n <= limit
+	if allowed {
+		for i := 0; i < n; i++ {
+			_, err = tx.ExecContext(ctx, `INSERT INTO request_log_entries (k, ts, expires_at) VALUES (?, ?, ?)`, key, now.UnixMicro(), now.Add(window))
+			if err != nil {
+				return false, 0, time.Time{}, err
+			}
+		}
+		if count == 0 {
+			oldest = now.UnixMicro()
+		}
+		count += n
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return allowed, count, time.UnixMicro(oldest), nil
+}
+
+func (m *MySQLStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	var nanos int64
+	err := m.db.QueryRowContext(ctx, `SELECT tat FROM gcra_tats WHERE k = ?`, key).Scan(&nanos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tatFromNanos(nanos), nil
+}
+
+func (m *MySQLStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	expiresAt := time.Now().Add(ttl)
+	if old.IsZero() {
+		res, err = m.db.ExecContext(ctx, `INSERT INTO gcra_tats (k, tat, expires_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE k = k`, key, tatNanos(tat), expiresAt)
+	} else {
+		res, err = m.db.ExecContext(ctx, `UPDATE gcra_tats SET tat = ?, expires_at = ? WHERE k = ? AND tat = ?`, tatNanos(tat), expiresAt, key, tatNanos(old))
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (m *MySQLStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Upserting the set's head row locks it, which serializes concurrent
+	// acquisitions for the same key for the rest of the transaction.
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO lease_sets (k, expires_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at)`, key, now.Add(ttl))
+	if err != nil {
+		return false, 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM leases WHERE k = ? AND expires_at <= ?`, key, now.UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+
+	var count, held int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(CASE WHEN id = ? THEN 1 ELSE 0 END), 0) FROM leases WHERE k = ?`, id, key).Scan(&count, &held)
+	if err != nil {
+		return false, 0, err
+	}
+	if held == 0 && count >= limit {
+		return false, count, nil
+	}
+	if held == 0 {
+		count++
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO leases (k, id, expires_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE expires_at = VALUES(expires_at)`, key, id, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return true, count, nil
+}
+
+func (m *MySQLStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	_, err := m.db.ExecContext(ctx, `DELETE FROM leases WHERE k = ? AND id = ?`, key, id)
+	return err
+}
+
+func (m *MySQLStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	_, err := m.db.ExecContext(ctx, `INSERT INTO limit_overrides (k, request_limit, window_ms, burst, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE request_limit = VALUES(request_limit), window_ms = VALUES(window_ms), burst = VALUES(burst), expires_at = VALUES(expires_at)`,
+		key, override.Limit, override.Window.Milliseconds(), override.Burst, override.ExpiresAt.UnixMilli())
+	return err
+}
+
+func (m *MySQLStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	var (
+		override  Override
+		windowMs  int64
+		expiresAt int64
+	)
+	err := m.db.QueryRowContext(ctx, `SELECT request_limit, window_ms, burst, expires_at FROM limit_overrides WHERE k = ? AND expires_at > ?`, key, time.Now().UnixMilli()).
+		Scan(&override.Limit, &windowMs, &override.Burst, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	override.Window = time.Duration(windowMs) * time.Millisecond
+	override.ExpiresAt = time.UnixMilli(expiresAt)
+	return &override, nil
+}
+
+func (m *MySQLStorage) DeleteOverride(ctx context.Context, key string) error {
+	_, err := m.db.ExecContext(ctx, `DELETE FROM limit_overrides WHERE k = ?`, key)
+	return err
+}
+
+// TokenTier returns the tier the token_tiers table assigns token, or "" if
+// it has none.
+func (m *MySQLStorage) TokenTier(ctx context.Context, token string) (string, error) {
+	var tier string
+	err := m.db.QueryRowContext(ctx, `SELECT tier FROM token_tiers WHERE token = ?`, token).Scan(&tier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tier, err
+}
+
 func (m *MySQLStorage) Close() error {
+	m.janitor.stop()
 	return m.db.Close()
 }
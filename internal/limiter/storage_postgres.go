@@ -10,63 +10,104 @@ import (
 )
 
 type PostgresStorage struct {
-	db *sql.DB
+	db      *sql.DB
+	janitor *janitor
 }
 
-func NewPostgresStorage(dsn string) (*PostgresStorage, error) {
+// NewPostgresStorage connects to the PostgreSQL database at dsn and applies
+// pending schema migrations if autoMigrate is set. Unless cleanupInterval is
+// zero, expired rows are deleted every cleanupInterval, at most
+// cleanupBatchSize rows per statement.
+func NewPostgresStorage(dsn string, autoMigrate bool, cleanupInterval time.Duration, cleanupBatchSize int) (*PostgresStorage, error) {
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(context.Background(), db, postgresDialect, autoMigrate); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[PostgreSQL] Using PostgreSQL storage strategy")
+	p := &PostgresStorage{db: db}
+	if cleanupInterval > 0 {
+		p.janitor = startJanitor("PostgreSQL", cleanupInterval, cleanupBatchSize, p.janitorTasks())
+	}
+	return p, nil
+}
+
+func openPostgres(dsn string) (*sql.DB, error) {
 	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open postgres connection: %w", err)
 	}
 	if err := db.Ping(); err != nil {
+		_ = db.Close()
 		return nil, fmt.Errorf("failed to ping postgres: %w", err)
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS rate_limits (k TEXT PRIMARY KEY, count INT NOT NULL, expires_at TIMESTAMP)`); err != nil {
-		return nil, fmt.Errorf("create table rate_limits: %w", err)
+	return db, nil
+}
+
+// janitorTasks deletes batches by ctid, since PostgreSQL's DELETE takes no
+// LIMIT.
+func (p *PostgresStorage) janitorTasks() []janitorTask {
+	expired := func(table string) janitorTask {
+		return janitorTask{table: table, deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, p.db, `DELETE FROM `+table+` WHERE ctid IN (SELECT ctid FROM `+table+` WHERE expires_at < $1 LIMIT $2)`, now, limit)
+		}}
 	}
-	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS bans (k TEXT PRIMARY KEY, expires_at TIMESTAMP)`); err != nil {
-		return nil, fmt.Errorf("create table bans: %w", err)
+	return []janitorTask{
+		expired("rate_limits"),
+		expired("bans"),
+		expired("token_buckets"),
+		expired("gcra_tats"),
+		expired("request_logs"),
+		expired("request_log_entries"),
+		expired("lease_sets"),
+		{table: "leases", deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, p.db, `DELETE FROM leases WHERE ctid IN (SELECT ctid FROM leases WHERE expires_at < $1 LIMIT $2)`, now.UnixMilli(), limit)
+		}},
+		{table: "limit_overrides", deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, p.db, `DELETE FROM limit_overrides WHERE ctid IN (SELECT ctid FROM limit_overrides WHERE expires_at < $1 LIMIT $2)`, now.UnixMilli(), limit)
+		}},
 	}
-	log.Printf("[PostgreSQL] Using PostgreSQL storage strategy")
-	return &PostgresStorage{db: db}, nil
+}
+
+// CleanupStats reports how many expired rows the janitor has deleted.
+func (p *PostgresStorage) CleanupStats() CleanupStats {
+	return p.janitor.Stats()
 }
 
 func (p *PostgresStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
-	tx, err := p.db.BeginTx(ctx, nil)
+	return p.IncrementBy(ctx, key, 1, window)
+}
+
+func (p *PostgresStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	now := time.Now()
+	var count int
+	err := p.db.QueryRowContext(ctx, `INSERT INTO rate_limits (k, count, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (k) DO UPDATE SET
+			count = CASE WHEN rate_limits.expires_at IS NULL OR rate_limits.expires_at < $4 THEN EXCLUDED.count ELSE rate_limits.count + EXCLUDED.count END,
+			expires_at = EXCLUDED.expires_at
+		RETURNING count`,
+		key, n, now.Add(window), now).Scan(&count)
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		if err != nil {
-			_ = tx.Rollback()
-		} else {
-			_ = tx.Commit()
-		}
-	}()
+	return count, nil
+}
 
+func (p *PostgresStorage) GetCount(ctx context.Context, key string) (int, error) {
 	var count int
 	var expiresAt sql.NullTime
-	err = tx.QueryRowContext(ctx, `SELECT count, expires_at FROM rate_limits WHERE k = $1 FOR UPDATE`, key).Scan(&count, &expiresAt)
+	err := p.db.QueryRowContext(ctx, `SELECT count, expires_at FROM rate_limits WHERE k = $1`, key).Scan(&count, &expiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
-		count = 1
-		expiresAt := time.Now().Add(window)
-		_, err = tx.ExecContext(ctx, `INSERT INTO rate_limits (k, count, expires_at) VALUES ($1, $2, $3)`, key, count, expiresAt)
-		return count, err
+		return 0, nil
 	}
 	if err != nil {
 		return 0, err
 	}
-
-	now := time.Now()
-	if !expiresAt.Valid || expiresAt.Time.Before(now) {
-		count = 1
-	} else {
-		count++
-	}
-	expires := now.Add(window)
-	_, err = tx.ExecContext(ctx, `UPDATE rate_limits SET count=$1, expires_at=$2 WHERE k=$3`, count, expires, key)
-	if err != nil {
-		return 0, err
+	if !expiresAt.Valid || expiresAt.Time.Before(time.Now()) {
+		return 0, nil
 	}
 	return count, nil
 }
@@ -94,7 +135,7 @@ func (p *PostgresStorage) IsBanned(ctx context.Context, key string) (bool, error
 
 func (p *PostgresStorage) GetBanReset(ctx context.Context, key string) (time.Duration, error) {
 	var expiresAt time.Time
-	err := p.db.QueryRowContext(ctx, `SELECT expires_at FROM bans WHERE k = ?`, key).Scan(&expiresAt)
+	err := p.db.QueryRowContext(ctx, `SELECT expires_at FROM bans WHERE k = $1`, key).Scan(&expiresAt)
 	if errors.Is(err, sql.ErrNoRows) {
 		return 0, nil
 	}
@@ -108,6 +149,211 @@ func (p *PostgresStorage) GetBanReset(ctx context.Context, key string) (time.Dur
 	return ttl, nil
 }
 
+func (p *PostgresStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Make sure the row exists so that concurrent first requests serialize on
+	// the row lock below instead of racing on the insert.
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO token_buckets (k, tokens, updated_at, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT (k) DO NOTHING`,
+		key, capacity, start.UnixMilli(), start.Add(bucketTTL(capacity, refillRate)))
+	if err != nil {
+		return false, 0, err
+	}
+
+	var tokens float64
+	var updatedAt int64
+	err = tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM token_buckets WHERE k = $1 FOR UPDATE`, key).Scan(&tokens, &updatedAt)
+	if err != nil {
+		return false, 0, err
+	}
+
+	now := time.Now()
+	allowed, tokens := takeFromBucket(tokens, time.UnixMilli(updatedAt), now, n, capacity, refillRate)
+	_, err = tx.ExecContext(ctx, `UPDATE token_buckets SET tokens = $1, updated_at = $2, expires_at = $3 WHERE k = $4`,
+		tokens, now.UnixMilli(), now.Add(bucketTTL(capacity, refillRate)), key)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+func (p *PostgresStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Upserting the log's head row locks it, which serializes concurrent
+	// requests for the same key for the rest of the transaction.
+	start := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO request_logs (k, expires_at) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET expires_at = EXCLUDED.expires_at`, key, start.Add(window))
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `DELETE FROM request_log_entries WHERE k = $1 AND ts <= $2`, key, now.Add(-window).UnixMicro())
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	var count int
+	var oldest int64
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MIN(ts), 0) FROM request_log_entries WHERE k = $1`, key).Scan(&count, &oldest)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	allowed := count+n <= limit
+	if allowed {
+		for i := 0; i < n; i++ {
+			_, err = tx.ExecContext(ctx, `INSERT INTO request_log_entries (k, ts, expires_at) VALUES ($1, $2, $3)`, key, now.UnixMicro(), now.Add(window))
+			if err != nil {
+				return false, 0, time.Time{}, err
+			}
+		}
+		if count == 0 {
+			oldest = now.UnixMicro()
+		}
+		count += n
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return allowed, count, time.UnixMicro(oldest), nil
+}
+
+func (p *PostgresStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	var nanos int64
+	err := p.db.QueryRowContext(ctx, `SELECT tat FROM gcra_tats WHERE k = $1`, key).Scan(&nanos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tatFromNanos(nanos), nil
+}
+
+func (p *PostgresStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	expiresAt := time.Now().Add(ttl)
+	if old.IsZero() {
+		res, err = p.db.ExecContext(ctx, `INSERT INTO gcra_tats (k, tat, expires_at) VALUES ($1, $2, $3) ON CONFLICT (k) DO NOTHING`, key, tatNanos(tat), expiresAt)
+	} else {
+		res, err = p.db.ExecContext(ctx, `UPDATE gcra_tats SET tat = $1, expires_at = $2 WHERE k = $3 AND tat = $4`, tatNanos(tat), expiresAt, key, tatNanos(old))
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (p *PostgresStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// Upserting the set's head row locks it, which serializes concurrent
+	// acquisitions for the same key for the rest of the transaction.
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `INSERT INTO lease_sets (k, expires_at) VALUES ($1, $2) ON CONFLICT (k) DO UPDATE SET expires_at = EXCLUDED.expires_at`, key, now.Add(ttl))
+	if err != nil {
+		return false, 0, err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM leases WHERE k = $1 AND expires_at <= $2`, key, now.UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+
+	var count, held int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(CASE WHEN id = $1 THEN 1 ELSE 0 END), 0) FROM leases WHERE k = $2`, id, key).Scan(&count, &held)
+	if err != nil {
+		return false, 0, err
+	}
+	if held == 0 && count >= limit {
+		return false, count, nil
+	}
+	if held == 0 {
+		count++
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO leases (k, id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (k, id) DO UPDATE SET expires_at = EXCLUDED.expires_at`, key, id, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return true, count, nil
+}
+
+func (p *PostgresStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM leases WHERE k = $1 AND id = $2`, key, id)
+	return err
+}
+
+func (p *PostgresStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	_, err := p.db.ExecContext(ctx, `INSERT INTO limit_overrides (k, request_limit, window_ms, burst, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (k) DO UPDATE SET request_limit = EXCLUDED.request_limit, window_ms = EXCLUDED.window_ms, burst = EXCLUDED.burst, expires_at = EXCLUDED.expires_at`,
+		key, override.Limit, override.Window.Milliseconds(), override.Burst, override.ExpiresAt.UnixMilli())
+	return err
+}
+
+func (p *PostgresStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	var (
+		override  Override
+		windowMs  int64
+		expiresAt int64
+	)
+	err := p.db.QueryRowContext(ctx, `SELECT request_limit, window_ms, burst, expires_at FROM limit_overrides WHERE k = $1 AND expires_at > $2`, key, time.Now().UnixMilli()).
+		Scan(&override.Limit, &windowMs, &override.Burst, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	override.Window = time.Duration(windowMs) * time.Millisecond
+	override.ExpiresAt = time.UnixMilli(expiresAt)
+	return &override, nil
+}
+
+func (p *PostgresStorage) DeleteOverride(ctx context.Context, key string) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM limit_overrides WHERE k = $1`, key)
+	return err
+}
+
+// TokenTier returns the tier the token_tiers table assigns token, or "" if
+// it has none.
+func (p *PostgresStorage) TokenTier(ctx context.Context, token string) (string, error) {
+	var tier string
+	err := p.db.QueryRowContext(ctx, `SELECT tier FROM token_tiers WHERE token = $1`, token).Scan(&tier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tier, err
+}
+
 func (p *PostgresStorage) Close() error {
+	p.janitor.stop()
 	return p.db.Close()
 }
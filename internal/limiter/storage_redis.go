@@ -6,11 +6,136 @@ import (
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"log"
+	"math/rand"
+	"strconv"
 	"time"
 )
 
+// takeTokenScript refills and drains a token bucket stored as a hash of
+// tokens and last update time (unix milliseconds) in a single round trip.
+var takeTokenScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate / 1000)
+end
+
+local allowed = 0
+local n = tonumber(ARGV[5])
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {allowed, tostring(tokens)}
+`)
+
+// logRequestScript trims a sorted set of request timestamps (unix
+// microseconds) to the trailing window and adds the current request's entries
+// if the limit allows it.
+var logRequestScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local n = tonumber(ARGV[5])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + n <= limit then
+	for i = 1, n do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. '-' .. i)
+	end
+	count = count + n
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {allowed, count, oldest[2] or tostring(now)}
+`)
+
+// compareAndSetScript replaces the value of a key only if it still holds the
+// expected one, where "0" stands for a missing key.
+var compareAndSetScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if (current == false and ARGV[1] == '0') or current == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// acquireLeaseScript keeps leases in a sorted set scored by their expiry time
+// (unix milliseconds), dropping expired ones before counting.
+var acquireLeaseScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+local held = redis.call('ZSCORE', KEYS[1], ARGV[4])
+local count = redis.call('ZCARD', KEYS[1])
+if held == false and count >= limit then
+	return {0, count}
+end
+if held == false then
+	count = count + 1
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return {1, count}
+`)
+
+// checkWindowsScript decides a fixed window request in one go. KEYS[1] is the
+// ban key and the remaining keys are window counters. ARGV holds the cost, the
+// block duration and then the limit, window and reset time (milliseconds) of
+// each window. The reply starts with 0 (allowed), 1 (banned) or 2 (denied),
+// followed by the ban TTL in seconds and the counter values.
+var checkWindowsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return {1, redis.call('TTL', KEYS[1])}
+end
+
+local cost = tonumber(ARGV[1])
+local block = tonumber(ARGV[2])
+local reply = {0, 0}
+for i = 2, #KEYS do
+	local base = 3 + (i - 2) * 3
+	local limit = tonumber(ARGV[base])
+	local count = redis.call('INCRBY', KEYS[i], cost)
+	redis.call('PEXPIRE', KEYS[i], ARGV[base + 1])
+	table.insert(reply, count)
+
+	if count > limit then
+		local ban = math.max(block, tonumber(ARGV[base + 2]))
+		redis.call('SET', KEYS[1], 'banned', 'PX', ban)
+		reply[1] = 2
+		reply[2] = redis.call('TTL', KEYS[1])
+		return reply
+	end
+end
+return reply
+`)
+
+// RedisStorage works against a single Redis server, a Sentinel-managed
+// primary or a Redis Cluster. The limiter hash-tags every key with the client
+// it belongs to, so the keys a script touches together share a cluster slot.
 type RedisStorage struct {
-	client *redis.Client
+	client redis.UniversalClient
 }
 
 func NewRedisStorage(redisURL string) (*RedisStorage, error) {
@@ -19,22 +144,53 @@ func NewRedisStorage(redisURL string) (*RedisStorage, error) {
 		return nil, fmt.Errorf("failed parsing Redis URL: %w", err)
 	}
 
-	client := redis.NewClient(opt)
+	return newRedisStorage(redis.NewClient(opt), "Redis")
+}
+
+// NewRedisSentinelStorage connects to the primary of masterName as reported by
+// the given Sentinel servers, following it across failovers.
+func NewRedisSentinelStorage(masterName string, sentinelAddrs []string, password string, db int) (*RedisStorage, error) {
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    masterName,
+		SentinelAddrs: sentinelAddrs,
+		Password:      password,
+		DB:            db,
+	})
+
+	return newRedisStorage(client, "Redis Sentinel")
+}
+
+// NewRedisClusterStorage connects to the Redis Cluster the given seed nodes
+// belong to.
+func NewRedisClusterStorage(addrs []string, password string) (*RedisStorage, error) {
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:    addrs,
+		Password: password,
+	})
+
+	return newRedisStorage(client, "Redis Cluster")
+}
 
+func newRedisStorage(client redis.UniversalClient, topology string) (*RedisStorage, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed connecting to Redis: %w", err)
+		_ = client.Close()
+		return nil, fmt.Errorf("failed connecting to %s: %w", topology, err)
 	}
-	log.Printf("[Redis] Using Redis storage strategy")
+	log.Printf("[Redis] Using %s storage strategy", topology)
 	return &RedisStorage{client: client}, nil
 }
 
 func (r *RedisStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	return r.IncrementBy(ctx, key, 1, window)
+}
+
+func (r *RedisStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
 	pipe := r.client.Pipeline()
 
-	incrCmd := pipe.Incr(ctx, key)
+	incrCmd := pipe.IncrBy(ctx, key, int64(n))
 
 	pipe.Expire(ctx, key, window)
 
@@ -50,6 +206,17 @@ func (r *RedisStorage) Increment(ctx context.Context, key string, window time.Du
 	return int(count), nil
 }
 
+func (r *RedisStorage) GetCount(ctx context.Context, key string) (int, error) {
+	count, err := r.client.Get(ctx, key).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed getting counter: %w", err)
+	}
+	return count, nil
+}
+
 func (r *RedisStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
 	err := r.client.Set(ctx, key, "banned", duration).Err()
 	if err != nil {
@@ -80,6 +247,154 @@ func (r *RedisStorage) GetBanReset(ctx context.Context, key string) (time.Durati
 	return ttl, nil
 }
 
+func (r *RedisStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	now := time.Now().UnixMilli()
+	ttl := bucketTTL(capacity, refillRate).Milliseconds()
+
+	res, err := takeTokenScript.Run(ctx, r.client, []string{key}, capacity, refillRate, now, ttl, n).Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed taking token: %w", err)
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected token bucket reply: %v", res)
+	}
+
+	allowed, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed parsing token count: %w", err)
+	}
+	return allowed == 1, tokens, nil
+}
+
+func (r *RedisStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	now := time.Now()
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), rand.Int63())
+
+	res, err := logRequestScript.Run(ctx, r.client, []string{key}, now.UnixMicro(), window.Microseconds(), limit, member, n).Slice()
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("failed logging request: %w", err)
+	}
+	if len(res) != 3 {
+		return false, 0, time.Time{}, fmt.Errorf("unexpected request log reply: %v", res)
+	}
+
+	allowed, _ := res[0].(int64)
+	count, _ := res[1].(int64)
+	oldestStr, _ := res[2].(string)
+	oldest, err := strconv.ParseFloat(oldestStr, 64)
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("failed parsing request timestamp: %w", err)
+	}
+	return allowed == 1, int(count), time.UnixMicro(int64(oldest)), nil
+}
+
+func (r *RedisStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	nanos, err := r.client.Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed getting arrival time: %w", err)
+	}
+	return tatFromNanos(nanos), nil
+}
+
+func (r *RedisStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	ttlMillis := ttl.Milliseconds()
+	if ttlMillis < 1 {
+		ttlMillis = 1
+	}
+	swapped, err := compareAndSetScript.Run(ctx, r.client, []string{key},
+		strconv.FormatInt(tatNanos(old), 10), strconv.FormatInt(tatNanos(tat), 10), ttlMillis).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed setting arrival time: %w", err)
+	}
+	return swapped == 1, nil
+}
+
+func (r *RedisStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	res, err := acquireLeaseScript.Run(ctx, r.client, []string{key}, time.Now().UnixMilli(), ttl.Milliseconds(), limit, id).Slice()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed acquiring lease: %w", err)
+	}
+	if len(res) != 2 {
+		return false, 0, fmt.Errorf("unexpected lease reply: %v", res)
+	}
+	acquired, _ := res[0].(int64)
+	count, _ := res[1].(int64)
+	return acquired == 1, int(count), nil
+}
+
+func (r *RedisStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	if err := r.client.ZRem(ctx, key, id).Err(); err != nil {
+		return fmt.Errorf("failed releasing lease: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	if err := r.client.Set(ctx, key, formatOverride(override), time.Until(override.ExpiresAt)).Err(); err != nil {
+		return fmt.Errorf("failed setting override: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	value, err := r.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting override: %w", err)
+	}
+	override, err := parseOverride(value)
+	if err != nil {
+		return nil, err
+	}
+	if !override.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	return override, nil
+}
+
+func (r *RedisStorage) DeleteOverride(ctx context.Context, key string) error {
+	if err := r.client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("failed deleting override: %w", err)
+	}
+	return nil
+}
+
+func (r *RedisStorage) CheckWindows(ctx context.Context, banKey string, windows []WindowCheck, cost int, blockDuration time.Duration) (*WindowCheckResult, error) {
+	keys := []string{banKey}
+	args := []interface{}{cost, blockDuration.Milliseconds()}
+	for _, w := range windows {
+		keys = append(keys, w.Key)
+		args = append(args, w.Limit, w.Window.Milliseconds(), w.ResetAfter.Milliseconds())
+	}
+
+	res, err := checkWindowsScript.Run(ctx, r.client, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed checking windows: %w", err)
+	}
+	if len(res) < 2 {
+		return nil, fmt.Errorf("unexpected window check reply: %v", res)
+	}
+
+	result := &WindowCheckResult{
+		Banned: res[0] == 1,
+		Denied: res[0] == 2,
+	}
+	if res[1] > 0 {
+		result.BanTTL = time.Duration(res[1]) * time.Second
+	}
+	for _, count := range res[2:] {
+		result.Counts = append(result.Counts, int(count))
+	}
+	return result, nil
+}
+
 func (r *RedisStorage) Close() error {
 	return r.client.Close()
 }
@@ -0,0 +1,337 @@
+package limiter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBusyTimeout is how long a statement waits for another connection or
+// process to release the database before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5 * time.Second
+
+// SQLiteStorage keeps its state in a local SQLite file. The file is opened in
+// WAL mode, so several processes on the same host can share it. Timestamps are
+// stored as Unix milliseconds because SQLite has no native time type.
+type SQLiteStorage struct {
+	db      *sql.DB
+	janitor *janitor
+}
+
+// NewSQLiteStorage opens or creates the database file at path and applies
+// pending schema migrations if autoMigrate is set. Unless cleanupInterval is
+// zero, expired rows are deleted every cleanupInterval, at most
+// cleanupBatchSize rows per statement.
+func NewSQLiteStorage(path string, autoMigrate bool, cleanupInterval time.Duration, cleanupBatchSize int) (*SQLiteStorage, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := prepareSchema(context.Background(), db, sqliteDialect, autoMigrate); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Printf("[SQLite] Using SQLite storage strategy at %s", path)
+	s := &SQLiteStorage{db: db}
+	if cleanupInterval > 0 {
+		s.janitor = startJanitor("SQLite", cleanupInterval, cleanupBatchSize, s.janitorTasks())
+	}
+	return s, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	params.Add("_pragma", "synchronous(NORMAL)")
+	// Transactions take the write lock up front. Read-modify-write sequences
+	// are then serialized across connections and processes, and two of them
+	// never deadlock trying to upgrade a read lock.
+	params.Add("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to ping sqlite: %w", err)
+	}
+	return db, nil
+}
+
+func (s *SQLiteStorage) janitorTasks() []janitorTask {
+	expired := func(table string) janitorTask {
+		return janitorTask{table: table, deleteBatch: func(ctx context.Context, now time.Time, limit int) (int64, error) {
+			return deleteRows(ctx, s.db, `DELETE FROM `+table+` WHERE rowid IN (SELECT rowid FROM `+table+` WHERE expires_at < ? LIMIT ?)`, now.UnixMilli(), limit)
+		}}
+	}
+	return []janitorTask{
+		expired("rate_limits"),
+		expired("bans"),
+		expired("token_buckets"),
+		expired("gcra_tats"),
+		expired("request_log_entries"),
+		expired("leases"),
+		expired("limit_overrides"),
+	}
+}
+
+// CleanupStats reports how many expired rows the janitor has deleted.
+func (s *SQLiteStorage) CleanupStats() CleanupStats {
+	return s.janitor.Stats()
+}
+
+func (s *SQLiteStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	return s.IncrementBy(ctx, key, 1, window)
+}
+
+func (s *SQLiteStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	now := time.Now()
+	var count int
+	err := s.db.QueryRowContext(ctx, `INSERT INTO rate_limits (k, count, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (k) DO UPDATE SET
+			count = CASE WHEN rate_limits.expires_at <= ? THEN excluded.count ELSE rate_limits.count + excluded.count END,
+			expires_at = excluded.expires_at
+		RETURNING count`,
+		key, n, now.Add(window).UnixMilli(), now.UnixMilli()).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *SQLiteStorage) GetCount(ctx context.Context, key string) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT count FROM rate_limits WHERE k = ? AND expires_at > ?`, key, time.Now().UnixMilli()).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *SQLiteStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
+	expiresAt := time.Now().Add(duration)
+	_, err := s.db.ExecContext(ctx, `INSERT INTO bans (k, expires_at) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET expires_at = excluded.expires_at`, key, expiresAt.UnixMilli())
+	return err
+}
+
+func (s *SQLiteStorage) IsBanned(ctx context.Context, key string) (bool, error) {
+	ttl, err := s.GetBanReset(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return ttl > 0, nil
+}
+
+func (s *SQLiteStorage) GetBanReset(ctx context.Context, key string) (time.Duration, error) {
+	var expiresAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT expires_at FROM bans WHERE k = ?`, key).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	ttl := time.Until(time.UnixMilli(expiresAt))
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+func (s *SQLiteStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now()
+	tokens := float64(capacity)
+	updatedAt := now.UnixMilli()
+	err = tx.QueryRowContext(ctx, `SELECT tokens, updated_at FROM token_buckets WHERE k = ?`, key).Scan(&tokens, &updatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, 0, err
+	}
+
+	allowed, tokens := takeFromBucket(tokens, time.UnixMilli(updatedAt), now, n, capacity, refillRate)
+	_, err = tx.ExecContext(ctx, `INSERT INTO token_buckets (k, tokens, updated_at, expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (k) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at, expires_at = excluded.expires_at`,
+		key, tokens, now.UnixMilli(), now.Add(bucketTTL(capacity, refillRate)).UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+func (s *SQLiteStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `DELETE FROM request_log_entries WHERE k = ? AND ts <= ?`, key, now.Add(-window).UnixMicro())
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	var count int
+	var oldest int64
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(MIN(ts), 0) FROM request_log_entries WHERE k = ?`, key).Scan(&count, &oldest)
+	if err != nil {
+		return false, 0, time.Time{}, err
+	}
+
+	allowed := count+n <= limit
+	if allowed {
+		for i := 0; i < n; i++ {
+			_, err = tx.ExecContext(ctx, `INSERT INTO request_log_entries (k, ts, expires_at) VALUES (?, ?, ?)`, key, now.UnixMicro(), now.Add(window).UnixMilli())
+			if err != nil {
+				return false, 0, time.Time{}, err
+			}
+		}
+		if count == 0 {
+			oldest = now.UnixMicro()
+		}
+		count += n
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return allowed, count, time.UnixMicro(oldest), nil
+}
+
+func (s *SQLiteStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	var nanos int64
+	err := s.db.QueryRowContext(ctx, `SELECT tat FROM gcra_tats WHERE k = ?`, key).Scan(&nanos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return tatFromNanos(nanos), nil
+}
+
+func (s *SQLiteStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	expiresAt := time.Now().Add(ttl).UnixMilli()
+	if old.IsZero() {
+		res, err = s.db.ExecContext(ctx, `INSERT INTO gcra_tats (k, tat, expires_at) VALUES (?, ?, ?) ON CONFLICT (k) DO NOTHING`, key, tatNanos(tat), expiresAt)
+	} else {
+		res, err = s.db.ExecContext(ctx, `UPDATE gcra_tats SET tat = ?, expires_at = ? WHERE k = ? AND tat = ?`, tatNanos(tat), expiresAt, key, tatNanos(old))
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+func (s *SQLiteStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, `DELETE FROM leases WHERE k = ? AND expires_at <= ?`, key, now.UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+
+	var count, held int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(CASE WHEN id = ? THEN 1 ELSE 0 END), 0) FROM leases WHERE k = ?`, id, key).Scan(&count, &held)
+	if err != nil {
+		return false, 0, err
+	}
+	if held == 0 && count >= limit {
+		return false, count, nil
+	}
+	if held == 0 {
+		count++
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO leases (k, id, expires_at) VALUES (?, ?, ?) ON CONFLICT (k, id) DO UPDATE SET expires_at = excluded.expires_at`, key, id, now.Add(ttl).UnixMilli())
+	if err != nil {
+		return false, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return true, count, nil
+}
+
+func (s *SQLiteStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM leases WHERE k = ? AND id = ?`, key, id)
+	return err
+}
+
+func (s *SQLiteStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO limit_overrides (k, request_limit, window_ms, burst, expires_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (k) DO UPDATE SET request_limit = excluded.request_limit, window_ms = excluded.window_ms, burst = excluded.burst, expires_at = excluded.expires_at`,
+		key, override.Limit, override.Window.Milliseconds(), override.Burst, override.ExpiresAt.UnixMilli())
+	return err
+}
+
+func (s *SQLiteStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	var (
+		override  Override
+		windowMs  int64
+		expiresAt int64
+	)
+	err := s.db.QueryRowContext(ctx, `SELECT request_limit, window_ms, burst, expires_at FROM limit_overrides WHERE k = ? AND expires_at > ?`, key, time.Now().UnixMilli()).
+		Scan(&override.Limit, &windowMs, &override.Burst, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	override.Window = time.Duration(windowMs) * time.Millisecond
+	override.ExpiresAt = time.UnixMilli(expiresAt)
+	return &override, nil
+}
+
+func (s *SQLiteStorage) DeleteOverride(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM limit_overrides WHERE k = ?`, key)
+	return err
+}
+
+// TokenTier returns the tier the token_tiers table assigns token, or "" if
+// it has none.
+func (s *SQLiteStorage) TokenTier(ctx context.Context, token string) (string, error) {
+	var tier string
+	err := s.db.QueryRowContext(ctx, `SELECT tier FROM token_tiers WHERE token = ?`, token).Scan(&tier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return tier, err
+}
+
+func (s *SQLiteStorage) Close() error {
+	s.janitor.stop()
+	return s.db.Close()
+}
@@ -0,0 +1,313 @@
+package limiter
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// tieredCounter is the local view of a counter in the shared storage: its
+// value as of the last sync plus the increments made here since.
+type tieredCounter struct {
+	mu        sync.Mutex
+	base      int
+	delta     int
+	synced    bool
+	syncedAt  time.Time
+	window    time.Duration
+	expiresAt time.Time
+}
+
+// tieredBan caches the ban state of a key until the given time: the end of the
+// ban if banned, the next check against the shared storage otherwise.
+type tieredBan struct {
+	banned bool
+	until  time.Time
+}
+
+// TieredStorage serves hot keys from process memory in front of a shared
+// storage. Bans are cached until they run out, and the absence of a ban for
+// syncInterval. Counters are incremented locally and the increments pushed to
+// the shared storage once maxUnsynced of them have piled up or syncInterval
+// has passed, whichever comes first.
+//
+// Counts are therefore approximate: across the cluster a limit can be
+// overshot by up to maxUnsynced-1 requests per instance, and a ban set by
+// another instance can take up to syncInterval to be seen. Token buckets,
+// request logs, arrival times and leases go straight to the shared storage.
+type TieredStorage struct {
+	remote       StorageStrategy
+	syncInterval time.Duration
+	maxUnsynced  int
+
+	mu       sync.Mutex
+	counters map[string]*tieredCounter
+	bans     map[string]tieredBan
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTieredStorage puts a local tier in front of remote and starts syncing it
+// every syncInterval.
+func NewTieredStorage(remote StorageStrategy, syncInterval time.Duration, maxUnsynced int) *TieredStorage {
+	t := &TieredStorage{
+		remote:       remote,
+		syncInterval: syncInterval,
+		maxUnsynced:  maxUnsynced,
+		counters:     make(map[string]*tieredCounter),
+		bans:         make(map[string]tieredBan),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go t.syncLoop()
+	log.Printf("[Tiered] Caching storage locally, syncing every %v or %d requests", syncInterval, maxUnsynced)
+	return t
+}
+
+func (t *TieredStorage) Increment(ctx context.Context, key string, window time.Duration) (int, error) {
+	return t.IncrementBy(ctx, key, 1, window)
+}
+
+func (t *TieredStorage) IncrementBy(ctx context.Context, key string, n int, window time.Duration) (int, error) {
+	now := time.Now()
+
+	t.mu.Lock()
+	c, ok := t.counters[key]
+	if !ok {
+		c = &tieredCounter{window: window, expiresAt: now.Add(window)}
+		t.counters[key] = c
+	}
+	t.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.expiresAt.After(now) {
+		// The increments of the last window still belong to the shared
+		// count: push them before starting over.
+		if c.delta > 0 {
+			if err := t.flush(ctx, key, c); err != nil {
+				log.Printf("[Tiered] Failed syncing %s before it expired: %v", key, err)
+			}
+		}
+		c.base = 0
+		c.delta = 0
+		c.synced = false
+		c.syncedAt = time.Time{}
+		c.window = window
+		c.expiresAt = now.Add(window)
+	}
+	c.delta += n
+
+	if c.synced && c.delta < t.maxUnsynced && now.Sub(c.syncedAt) < t.syncInterval {
+		return c.base + c.delta, nil
+	}
+
+	if err := t.flush(ctx, key, c); err != nil {
+		// Without a value from the shared storage there is nothing to
+		// estimate the count from.
+		if !c.synced {
+			c.delta -= n
+			return 0, err
+		}
+		log.Printf("[Tiered] Failed syncing %s, serving local count: %v", key, err)
+	}
+	return c.base + c.delta, nil
+}
+
+// flush pushes the unsynced increments of a counter to the shared storage.
+// The caller must hold the counter's lock.
+func (t *TieredStorage) flush(ctx context.Context, key string, c *tieredCounter) error {
+	count, err := t.remote.IncrementBy(ctx, key, c.delta, c.window)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	c.base = count
+	c.delta = 0
+	c.synced = true
+	c.syncedAt = now
+	c.expiresAt = now.Add(c.window)
+	return nil
+}
+
+func (t *TieredStorage) GetCount(ctx context.Context, key string) (int, error) {
+	t.mu.Lock()
+	c, ok := t.counters[key]
+	t.mu.Unlock()
+
+	if ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.synced && c.expiresAt.After(time.Now()) {
+			return c.base + c.delta, nil
+		}
+	}
+	return t.remote.GetCount(ctx, key)
+}
+
+func (t *TieredStorage) SetBan(ctx context.Context, key string, duration time.Duration) error {
+	if err := t.remote.SetBan(ctx, key, duration); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.bans[key] = tieredBan{banned: true, until: time.Now().Add(duration)}
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *TieredStorage) IsBanned(ctx context.Context, key string) (bool, error) {
+	if ban, ok := t.cachedBan(key); ok {
+		return ban.banned, nil
+	}
+
+	banned, err := t.remote.IsBanned(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	ban := tieredBan{until: time.Now().Add(t.syncInterval)}
+	if banned {
+		ttl, err := t.remote.GetBanReset(ctx, key)
+		if err != nil {
+			return false, err
+		}
+		ban = tieredBan{banned: true, until: time.Now().Add(ttl)}
+	}
+
+	t.mu.Lock()
+	t.bans[key] = ban
+	t.mu.Unlock()
+	return banned, nil
+}
+
+func (t *TieredStorage) GetBanReset(ctx context.Context, key string) (time.Duration, error) {
+	if ban, ok := t.cachedBan(key); ok && ban.banned {
+		return time.Until(ban.until), nil
+	}
+	return t.remote.GetBanReset(ctx, key)
+}
+
+// cachedBan returns the cached ban state of key if it is still valid.
+func (t *TieredStorage) cachedBan(key string) (tieredBan, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ban, ok := t.bans[key]
+	if !ok || !ban.until.After(time.Now()) {
+		return tieredBan{}, false
+	}
+	return ban, true
+}
+
+func (t *TieredStorage) TakeTokens(ctx context.Context, key string, n, capacity int, refillRate float64) (bool, float64, error) {
+	return t.remote.TakeTokens(ctx, key, n, capacity, refillRate)
+}
+
+func (t *TieredStorage) LogRequest(ctx context.Context, key string, n, limit int, window time.Duration) (bool, int, time.Time, error) {
+	return t.remote.LogRequest(ctx, key, n, limit, window)
+}
+
+func (t *TieredStorage) GetTAT(ctx context.Context, key string) (time.Time, error) {
+	return t.remote.GetTAT(ctx, key)
+}
+
+func (t *TieredStorage) CompareAndSetTAT(ctx context.Context, key string, old, tat time.Time, ttl time.Duration) (bool, error) {
+	return t.remote.CompareAndSetTAT(ctx, key, old, tat, ttl)
+}
+
+func (t *TieredStorage) AcquireLease(ctx context.Context, key, id string, limit int, ttl time.Duration) (bool, int, error) {
+	return t.remote.AcquireLease(ctx, key, id, limit, ttl)
+}
+
+func (t *TieredStorage) ReleaseLease(ctx context.Context, key, id string) error {
+	return t.remote.ReleaseLease(ctx, key, id)
+}
+
+func (t *TieredStorage) SetOverride(ctx context.Context, key string, override Override) error {
+	return t.remote.SetOverride(ctx, key, override)
+}
+
+func (t *TieredStorage) GetOverride(ctx context.Context, key string) (*Override, error) {
+	return t.remote.GetOverride(ctx, key)
+}
+
+func (t *TieredStorage) DeleteOverride(ctx context.Context, key string) error {
+	return t.remote.DeleteOverride(ctx, key)
+}
+
+func (t *TieredStorage) TokenTier(ctx context.Context, token string) (string, error) {
+	if store, ok := t.remote.(TokenTierStore); ok {
+		return store.TokenTier(ctx, token)
+	}
+	return "", nil
+}
+
+// Close pushes the increments not synced yet and closes the shared storage.
+func (t *TieredStorage) Close() error {
+	select {
+	case <-t.stop:
+	default:
+		close(t.stop)
+	}
+	<-t.done
+	return t.remote.Close()
+}
+
+// syncLoop pushes the increments of counters gone quiet every syncInterval and
+// forgets expired counters and bans, until Close is called.
+func (t *TieredStorage) syncLoop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			t.sync()
+			return
+		case <-ticker.C:
+			t.sync()
+		}
+	}
+}
+
+func (t *TieredStorage) sync() {
+	now := time.Now()
+
+	t.mu.Lock()
+	counters := make(map[string]*tieredCounter, len(t.counters))
+	for key, c := range t.counters {
+		counters[key] = c
+	}
+	for key, ban := range t.bans {
+		if !ban.until.After(now) {
+			delete(t.bans, key)
+		}
+	}
+	t.mu.Unlock()
+
+	for key, c := range counters {
+		c.mu.Lock()
+		if c.delta > 0 && c.synced {
+			if err := t.flush(context.Background(), key, c); err != nil {
+				log.Printf("[Tiered] Failed syncing %s: %v", key, err)
+			}
+		}
+		expired := !c.expiresAt.After(now) && c.delta == 0
+		c.mu.Unlock()
+
+		if expired {
+			t.mu.Lock()
+			if t.counters[key] == c {
+				delete(t.counters, key)
+			}
+			t.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,544 @@
+// Package storagetest checks that implementations of limiter.StorageStrategy
+// behave the same way, so the rate limiter makes the same decisions whatever
+// backend it runs on.
+//
+// A backend's tests call Run with a function creating a storage, and
+// RunUnavailable with a storage whose backend cannot be reached:
+//
+//	func TestMyStorageConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) limiter.StorageStrategy {
+//			storage, err := NewMyStorage(dsn)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return storage
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+)
+
+// ExpiryWindow is the shortest window the suite gives counters and bans it
+// waits out. Redis and Memcached do not expire keys with a finer precision
+// than a second.
+const ExpiryWindow = time.Second
+
+// expiryWait is how long the suite waits for ExpiryWindow to run out, leaving
+// room for backends rounding expiration times up to the next second.
+const expiryWait = 2*ExpiryWindow + 100*time.Millisecond
+
+// Run runs the conformance suite against the storages returned by newStorage,
+// which is called once per subtest. The storages are closed when their
+// subtest ends. Keys are unique to each run, so a backend holding data from
+// previous runs can be tested as is.
+func Run(t *testing.T, newStorage func(t *testing.T) limiter.StorageStrategy) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, storage limiter.StorageStrategy, key func(string) string)
+	}{
+		{"IncrementBy", testIncrementBy},
+		{"GetCountMissing", testGetCountMissing},
+		{"Expiry", testExpiry},
+		{"Bans", testBans},
+		{"BanExtended", testBanExtended},
+		{"IncrementByConcurrent", testIncrementByConcurrent},
+		{"TokenBuckets", testTokenBuckets},
+		{"RequestLogs", testRequestLogs},
+		{"TATs", testTATs},
+		{"Leases", testLeases},
+		{"Overrides", testOverrides},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newStorage(t)
+			t.Cleanup(func() {
+				if err := storage.Close(); err != nil {
+					t.Errorf("Close failed: %v", err)
+				}
+			})
+
+			prefix := fmt.Sprintf("conformance:%s:%d", strings.ReplaceAll(t.Name(), "/", ":"), time.Now().UnixNano())
+			tt.fn(t, storage, func(name string) string { return prefix + ":" + name })
+		})
+	}
+}
+
+// RunUnavailable checks that every operation of a storage whose backend
+// cannot be reached reports an error, rather than passing for an empty
+// counter or a client that is not banned.
+func RunUnavailable(t *testing.T, storage limiter.StorageStrategy) {
+	ctx := context.Background()
+	key := fmt.Sprintf("conformance:unavailable:%d", time.Now().UnixNano())
+	now := time.Now()
+
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Increment", func() error {
+			_, err := storage.Increment(ctx, key+":counter", time.Minute)
+			return err
+		}},
+		{"IncrementBy", func() error {
+			_, err := storage.IncrementBy(ctx, key+":counter", 2, time.Minute)
+			return err
+		}},
+		{"GetCount", func() error {
+			_, err := storage.GetCount(ctx, key+":counter")
+			return err
+		}},
+		{"SetBan", func() error {
+			return storage.SetBan(ctx, key+":ban", time.Minute)
+		}},
+		{"IsBanned", func() error {
+			_, err := storage.IsBanned(ctx, key+":ban")
+			return err
+		}},
+		{"GetBanReset", func() error {
+			_, err := storage.GetBanReset(ctx, key+":ban")
+			return err
+		}},
+		{"TakeTokens", func() error {
+			_, _, err := storage.TakeTokens(ctx, key+":bucket", 1, 10, 1)
+			return err
+		}},
+		{"LogRequest", func() error {
+			_, _, _, err := storage.LogRequest(ctx, key+":log", 1, 10, time.Minute)
+			return err
+		}},
+		{"GetTAT", func() error {
+			_, err := storage.GetTAT(ctx, key+":tat")
+			return err
+		}},
+		{"CompareAndSetTAT", func() error {
+			_, err := storage.CompareAndSetTAT(ctx, key+":tat", time.Time{}, now, time.Minute)
+			return err
+		}},
+		{"AcquireLease", func() error {
+			_, _, err := storage.AcquireLease(ctx, key+":conc", "lease", 10, time.Minute)
+			return err
+		}},
+		{"ReleaseLease", func() error {
+			return storage.ReleaseLease(ctx, key+":conc", "lease")
+		}},
+		{"SetOverride", func() error {
+			return storage.SetOverride(ctx, key+":override", limiter.Override{Limit: 10, Window: time.Second, ExpiresAt: now.Add(time.Minute)})
+		}},
+		{"GetOverride", func() error {
+			_, err := storage.GetOverride(ctx, key+":override")
+			return err
+		}},
+		{"DeleteOverride", func() error {
+			return storage.DeleteOverride(ctx, key+":override")
+		}},
+	}
+
+	for _, check := range checks {
+		if err := check.fn(); err == nil {
+			t.Errorf("%s succeeded against an unavailable storage", check.name)
+		}
+	}
+}
+
+func testIncrementBy(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	expectCount(t, "IncrementBy", 3)(storage.IncrementBy(ctx, key("a"), 3, time.Minute))
+	expectCount(t, "Increment", 4)(storage.Increment(ctx, key("a"), time.Minute))
+	expectCount(t, "IncrementBy", 9)(storage.IncrementBy(ctx, key("a"), 5, time.Minute))
+	expectCount(t, "GetCount", 9)(storage.GetCount(ctx, key("a")))
+
+	// Counters are independent of each other.
+	expectCount(t, "Increment of another key", 1)(storage.Increment(ctx, key("b"), time.Minute))
+	expectCount(t, "GetCount", 9)(storage.GetCount(ctx, key("a")))
+}
+
+func testGetCountMissing(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	expectCount(t, "GetCount of a missing key", 0)(storage.GetCount(context.Background(), key("missing")))
+}
+
+func testExpiry(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	expectCount(t, "IncrementBy", 2)(storage.IncrementBy(ctx, key("counter"), 2, ExpiryWindow))
+	if err := storage.SetBan(ctx, key("ban"), ExpiryWindow); err != nil {
+		t.Fatalf("SetBan failed: %v", err)
+	}
+	override := limiter.Override{Limit: 10, Window: time.Second, ExpiresAt: time.Now().Add(ExpiryWindow)}
+	if err := storage.SetOverride(ctx, key("override"), override); err != nil {
+		t.Fatalf("SetOverride failed: %v", err)
+	}
+	expectLog(t, "LogRequest", true, 2)(storage.LogRequest(ctx, key("log"), 2, 2, ExpiryWindow))
+	expectLease(t, "AcquireLease", true, 1)(storage.AcquireLease(ctx, key("conc"), "a", 1, ExpiryWindow))
+
+	time.Sleep(expiryWait)
+
+	expectCount(t, "GetCount after expiry", 0)(storage.GetCount(ctx, key("counter")))
+	expectCount(t, "IncrementBy after expiry", 1)(storage.IncrementBy(ctx, key("counter"), 1, time.Minute))
+
+	banned, err := storage.IsBanned(ctx, key("ban"))
+	if err != nil {
+		t.Fatalf("IsBanned failed: %v", err)
+	}
+	if banned {
+		t.Errorf("IsBanned = true after the ban expired")
+	}
+	ttl, err := storage.GetBanReset(ctx, key("ban"))
+	if err != nil {
+		t.Fatalf("GetBanReset failed: %v", err)
+	}
+	if ttl > 0 {
+		t.Errorf("GetBanReset = %v after the ban expired, want 0", ttl)
+	}
+
+	expectOverride(t, storage, key("override"), nil)
+
+	// Entries older than the window are trimmed, and leases not renewed
+	// within their TTL free their slot.
+	expectLog(t, "LogRequest after expiry", true, 2)(storage.LogRequest(ctx, key("log"), 2, 2, ExpiryWindow))
+	expectLease(t, "AcquireLease after expiry", true, 1)(storage.AcquireLease(ctx, key("conc"), "b", 1, ExpiryWindow))
+}
+
+func testBans(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	banned, err := storage.IsBanned(ctx, key("ban"))
+	if err != nil {
+		t.Fatalf("IsBanned failed: %v", err)
+	}
+	if banned {
+		t.Errorf("IsBanned = true before any ban")
+	}
+	ttl, err := storage.GetBanReset(ctx, key("ban"))
+	if err != nil {
+		t.Fatalf("GetBanReset failed: %v", err)
+	}
+	if ttl != 0 {
+		t.Errorf("GetBanReset = %v before any ban, want 0", ttl)
+	}
+
+	if err := storage.SetBan(ctx, key("ban"), time.Minute); err != nil {
+		t.Fatalf("SetBan failed: %v", err)
+	}
+
+	banned, err = storage.IsBanned(ctx, key("ban"))
+	if err != nil {
+		t.Fatalf("IsBanned failed: %v", err)
+	}
+	if !banned {
+		t.Errorf("IsBanned = false after SetBan")
+	}
+	expectTTL(t, storage, key("ban"), 58*time.Second, time.Minute)
+
+	banned, err = storage.IsBanned(ctx, key("other"))
+	if err != nil {
+		t.Fatalf("IsBanned failed: %v", err)
+	}
+	if banned {
+		t.Errorf("IsBanned = true for a key never banned")
+	}
+}
+
+func testBanExtended(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	if err := storage.SetBan(ctx, key("ban"), time.Minute); err != nil {
+		t.Fatalf("SetBan failed: %v", err)
+	}
+	if err := storage.SetBan(ctx, key("ban"), 2*time.Minute); err != nil {
+		t.Fatalf("SetBan failed: %v", err)
+	}
+	expectTTL(t, storage, key("ban"), 118*time.Second, 2*time.Minute)
+}
+
+func testTokenBuckets(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	// A new bucket starts full and refuses what it does not hold, leaving its
+	// tokens in place.
+	expectTokens(t, "TakeTokens", true, 2)(storage.TakeTokens(ctx, key("bucket"), 3, 5, 1))
+	expectTokens(t, "TakeTokens beyond the tokens left", false, 2)(storage.TakeTokens(ctx, key("bucket"), 3, 5, 1))
+	expectTokens(t, "TakeTokens", true, 0)(storage.TakeTokens(ctx, key("bucket"), 2, 5, 1))
+
+	// Refilling at 10 tokens a second, a drained bucket holds about 3 tokens
+	// 300ms later.
+	expectTokens(t, "TakeTokens", true, 0)(storage.TakeTokens(ctx, key("refill"), 5, 5, 10))
+	time.Sleep(300 * time.Millisecond)
+	expectTokens(t, "TakeTokens after refilling", true, 1)(storage.TakeTokens(ctx, key("refill"), 2, 5, 10))
+
+	// Refilling never takes a bucket beyond its capacity.
+	expectTokens(t, "TakeTokens", true, 4)(storage.TakeTokens(ctx, key("capacity"), 1, 5, 1000))
+	time.Sleep(50 * time.Millisecond)
+	expectTokens(t, "TakeTokens after refilling", true, 4)(storage.TakeTokens(ctx, key("capacity"), 1, 5, 1000))
+	time.Sleep(50 * time.Millisecond)
+	expectTokens(t, "TakeTokens beyond capacity", false, 5)(storage.TakeTokens(ctx, key("capacity"), 6, 5, 1000))
+}
+
+func testRequestLogs(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	start := time.Now()
+	allowed, count, oldest, err := storage.LogRequest(ctx, key("log"), 2, 3, time.Minute)
+	expectLog(t, "LogRequest", true, 2)(allowed, count, oldest, err)
+	// Entries are kept to the millisecond at least.
+	if oldest.Before(start.Add(-time.Millisecond)) || oldest.After(time.Now()) {
+		t.Errorf("LogRequest oldest entry = %v, want between %v and now", oldest, start)
+	}
+
+	// A request not fitting the limit is refused as a whole and not recorded.
+	expectLog(t, "LogRequest beyond the limit", false, 2)(storage.LogRequest(ctx, key("log"), 2, 3, time.Minute))
+	expectLog(t, "LogRequest", true, 3)(storage.LogRequest(ctx, key("log"), 1, 3, time.Minute))
+	expectLog(t, "LogRequest of a full log", false, 3)(storage.LogRequest(ctx, key("log"), 1, 3, time.Minute))
+
+	// Logs are independent of each other.
+	expectLog(t, "LogRequest of another key", true, 1)(storage.LogRequest(ctx, key("other"), 1, 3, time.Minute))
+
+	// Entries older than the window are dropped, however long the log is
+	// kept, so a shorter window trims it.
+	time.Sleep(300 * time.Millisecond)
+	expectLog(t, "LogRequest with a shorter window", true, 1)(storage.LogRequest(ctx, key("log"), 1, 3, 200*time.Millisecond))
+}
+
+func testTATs(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	expectTAT(t, storage, key("tat"), time.Time{})
+
+	first := time.Now().Add(time.Second)
+	expectSet(t, "CompareAndSetTAT of a missing key", true)(storage.CompareAndSetTAT(ctx, key("tat"), time.Time{}, first, time.Minute))
+	expectTAT(t, storage, key("tat"), first)
+
+	// A stale old value, including the zero time once the key exists, leaves
+	// the TAT as it is.
+	second := first.Add(time.Second)
+	expectSet(t, "CompareAndSetTAT expecting a missing key", false)(storage.CompareAndSetTAT(ctx, key("tat"), time.Time{}, second, time.Minute))
+	expectSet(t, "CompareAndSetTAT with a stale old value", false)(storage.CompareAndSetTAT(ctx, key("tat"), first.Add(-time.Millisecond), second, time.Minute))
+	expectTAT(t, storage, key("tat"), first)
+
+	expectSet(t, "CompareAndSetTAT", true)(storage.CompareAndSetTAT(ctx, key("tat"), first, second, time.Minute))
+	expectTAT(t, storage, key("tat"), second)
+	expectTAT(t, storage, key("other"), time.Time{})
+}
+
+func testLeases(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	expectLease(t, "AcquireLease", true, 1)(storage.AcquireLease(ctx, key("conc"), "a", 2, time.Minute))
+	expectLease(t, "AcquireLease", true, 2)(storage.AcquireLease(ctx, key("conc"), "b", 2, time.Minute))
+	expectLease(t, "AcquireLease beyond the limit", false, 2)(storage.AcquireLease(ctx, key("conc"), "c", 2, time.Minute))
+
+	// A lease held already is renewed rather than counted twice.
+	expectLease(t, "AcquireLease renewing a lease", true, 2)(storage.AcquireLease(ctx, key("conc"), "a", 2, time.Minute))
+
+	if err := storage.ReleaseLease(ctx, key("conc"), "b"); err != nil {
+		t.Fatalf("ReleaseLease failed: %v", err)
+	}
+	expectLease(t, "AcquireLease after a release", true, 2)(storage.AcquireLease(ctx, key("conc"), "c", 2, time.Minute))
+	if err := storage.ReleaseLease(ctx, key("conc"), "missing"); err != nil {
+		t.Errorf("ReleaseLease of a missing lease failed: %v", err)
+	}
+
+	// Lease sets are independent of each other.
+	expectLease(t, "AcquireLease of another key", true, 1)(storage.AcquireLease(ctx, key("other"), "a", 2, time.Minute))
+}
+
+func testOverrides(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	ctx := context.Background()
+
+	expectOverride(t, storage, key("override"), nil)
+
+	// Expiry times are compared to the millisecond, the precision the SQL
+	// storages keep.
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	override := limiter.Override{Limit: 100, Window: time.Minute, Burst: 150, ExpiresAt: expiresAt}
+	if err := storage.SetOverride(ctx, key("override"), override); err != nil {
+		t.Fatalf("SetOverride failed: %v", err)
+	}
+	expectOverride(t, storage, key("override"), &override)
+
+	replaced := limiter.Override{Limit: 5, Window: time.Second, ExpiresAt: expiresAt.Add(time.Hour)}
+	if err := storage.SetOverride(ctx, key("override"), replaced); err != nil {
+		t.Fatalf("SetOverride failed: %v", err)
+	}
+	expectOverride(t, storage, key("override"), &replaced)
+	expectOverride(t, storage, key("other"), nil)
+
+	if err := storage.DeleteOverride(ctx, key("override")); err != nil {
+		t.Fatalf("DeleteOverride failed: %v", err)
+	}
+	expectOverride(t, storage, key("override"), nil)
+	if err := storage.DeleteOverride(ctx, key("override")); err != nil {
+		t.Errorf("DeleteOverride of a missing override failed: %v", err)
+	}
+}
+
+// testIncrementByConcurrent fires many simultaneous first increments at a new
+// key and checks that none of them fails or gets lost.
+func testIncrementByConcurrent(t *testing.T, storage limiter.StorageStrategy, key func(string) string) {
+	const workers = 50
+
+	ctx := context.Background()
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		seen  = make(chan int, workers)
+		errs  = make(chan error, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			count, err := storage.IncrementBy(ctx, key("counter"), 1, time.Minute)
+			if err != nil {
+				errs <- err
+				return
+			}
+			seen <- count
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(seen)
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("IncrementBy failed: %v", err)
+	}
+
+	counts := make(map[int]bool)
+	for count := range seen {
+		if counts[count] {
+			t.Errorf("count %d returned twice", count)
+		}
+		counts[count] = true
+	}
+	for i := 1; i <= workers; i++ {
+		if !counts[i] {
+			t.Errorf("count %d never returned", i)
+		}
+	}
+
+	expectCount(t, "GetCount", workers)(storage.GetCount(ctx, key("counter")))
+}
+
+// expectCount returns a function checking the result of a counter operation,
+// so that the operation can be passed to it directly.
+func expectCount(t *testing.T, op string, want int) func(int, error) {
+	t.Helper()
+	return func(count int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if count != want {
+			t.Errorf("%s = %d, want %d", op, count, want)
+		}
+	}
+}
+
+// expectTokens returns a function checking the result of TakeTokens. Buckets
+// refill while the suite runs, so a little more than want tokens may be left.
+func expectTokens(t *testing.T, op string, wantTaken bool, want float64) func(bool, float64, error) {
+	t.Helper()
+	return func(taken bool, tokens float64, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if taken != wantTaken || tokens < want-0.01 || tokens > want+0.5 {
+			t.Errorf("%s = %v with %.2f tokens left, want %v with %v", op, taken, tokens, wantTaken, want)
+		}
+	}
+}
+
+// expectLog returns a function checking the result of LogRequest.
+func expectLog(t *testing.T, op string, wantAllowed bool, want int) func(bool, int, time.Time, error) {
+	t.Helper()
+	return func(allowed bool, count int, _ time.Time, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if allowed != wantAllowed || count != want {
+			t.Errorf("%s = %v with %d entries, want %v with %d", op, allowed, count, wantAllowed, want)
+		}
+	}
+}
+
+// expectLease returns a function checking the result of AcquireLease.
+func expectLease(t *testing.T, op string, wantHeld bool, want int) func(bool, int, error) {
+	t.Helper()
+	return func(held bool, active int, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if held != wantHeld || active != want {
+			t.Errorf("%s = %v with %d active leases, want %v with %d", op, held, active, wantHeld, want)
+		}
+	}
+}
+
+// expectSet returns a function checking the result of CompareAndSetTAT.
+func expectSet(t *testing.T, op string, want bool) func(bool, error) {
+	t.Helper()
+	return func(set bool, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s failed: %v", op, err)
+		}
+		if set != want {
+			t.Errorf("%s = %v, want %v", op, set, want)
+		}
+	}
+}
+
+func expectTAT(t *testing.T, storage limiter.StorageStrategy, key string, want time.Time) {
+	t.Helper()
+	tat, err := storage.GetTAT(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetTAT failed: %v", err)
+	}
+	if !tat.Equal(want) {
+		t.Errorf("GetTAT = %v, want %v", tat, want)
+	}
+}
+
+func expectOverride(t *testing.T, storage limiter.StorageStrategy, key string, want *limiter.Override) {
+	t.Helper()
+	got, err := storage.GetOverride(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetOverride failed: %v", err)
+	}
+	switch {
+	case want == nil && got != nil:
+		t.Errorf("GetOverride = %+v, want none", *got)
+	case want != nil && got == nil:
+		t.Errorf("GetOverride = none, want %+v", *want)
+	case want != nil && (got.Limit != want.Limit || got.Window != want.Window || got.Burst != want.Burst || !got.ExpiresAt.Equal(want.ExpiresAt)):
+		t.Errorf("GetOverride = %+v, want %+v", *got, *want)
+	}
+}
+
+func expectTTL(t *testing.T, storage limiter.StorageStrategy, key string, min, max time.Duration) {
+	t.Helper()
+	ttl, err := storage.GetBanReset(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetBanReset failed: %v", err)
+	}
+	if ttl < min || ttl > max {
+		t.Errorf("GetBanReset = %v, want between %v and %v", ttl, min, max)
+	}
+}
@@ -0,0 +1,43 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+)
+
+// TokenTierStore is implemented by storages holding the tier of each API
+// token, such as the token_tiers table of the SQL storages.
+type TokenTierStore interface {
+	// TokenTier returns the tier of token, or "" if it has none.
+	TokenTier(ctx context.Context, token string) (string, error)
+}
+
+// tokenTier returns the tier the policy file assigns token or, failing that
+// and if cfg says so, the one the storage holds for it.
+func (rl *RateLimiter) tokenTier(ctx context.Context, cfg *config.Config, token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	if cfg.Policy != nil {
+		if tier, ok := cfg.Policy.TokenTiers[token]; ok {
+			return tier, nil
+		}
+	}
+
+	store, ok := rl.storage.(TokenTierStore)
+	if cfg.TokenTierSource != "storage" || !ok {
+		return "", nil
+	}
+	if tier, ok := rl.tiers.get(token); ok {
+		return tier, nil
+	}
+
+	tier, err := store.TokenTier(ctx, token)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up token tier: %w", err)
+	}
+	rl.tiers.put(token, tier, cfg.TokenTierCacheTTL)
+	return tier, nil
+}
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// AdminTokenHeader carries the token admin endpoints are protected with.
+const AdminTokenHeader = "X-Admin-Token"
+
+// AdminAuthMiddleware rejects requests not presenting token in
+// AdminTokenHeader.
+func AdminAuthMiddleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(AdminTokenHeader)), []byte(token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error":   "Unauthorized",
+				"message": "A valid " + AdminTokenHeader + " header is required",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
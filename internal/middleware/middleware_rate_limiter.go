@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
 	"net/http"
@@ -8,43 +10,142 @@ import (
 	"time"
 )
 
+// CostHeader lets a request declare, or a handler report in its response, how
+// many requests the call counts as.
+const CostHeader = "X-RateLimit-Cost"
+
 func RateLimitMiddleware(rateLimiter *limiter.RateLimiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		clientIP := c.ClientIP()
-
-		apiToken := c.GetHeader("API_KEY")
-		if apiToken == "" {
-			apiToken = c.GetHeader("Authorization")
-			if len(apiToken) > 7 && apiToken[:7] == "Bearer " {
-				apiToken = apiToken[7:]
-			}
-		}
+		req := clientRequest(c)
+		cost := requestCost(c, rateLimiter)
 
-		result, err := rateLimiter.Check(c.Request.Context(), clientIP, apiToken)
+		result, err := rateLimiter.Check(c.Request.Context(), req, cost)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error":   err.Error(),
-				"message": "Internal Server Error",
-			})
-			c.Abort()
+			if storageFailed(c, rateLimiter, err) {
+				c.Next()
+			}
 			return
 		}
 
 		c.Header("X-RateLimit-Limit", strconv.Itoa(result.Limit))
 		c.Header("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
 		c.Header("X-RateLimit-Reset", strconv.FormatInt(result.ResetTime.Unix(), 10))
+		if result.Rule != "" {
+			c.Header("X-RateLimit-Rule", result.Rule)
+		}
+		if result.Tier != "" {
+			c.Header("X-RateLimit-Tier", result.Tier)
+		}
+
+		if result.Quota != nil {
+			c.Header("X-Quota-Limit", strconv.Itoa(result.Quota.Limit))
+			c.Header("X-Quota-Remaining", strconv.Itoa(result.Quota.Remaining))
+			c.Header("X-Quota-Reset", strconv.FormatInt(result.Quota.ResetTime.Unix(), 10))
+		}
+
+		if result.ConcurrencyExceeded {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":               "Concurrency Limit Exceeded",
+				"message":             result.Reason,
+				"retry_after_seconds": 1,
+			})
+			c.Abort()
+			return
+		}
 
 		if !result.Allowed {
 			c.Header("Retry-After", strconv.FormatInt(int64(result.ResetTime.Sub(time.Now()).Seconds()), 10))
 
+			reason := "Rate Limit Exceeded"
+			if result.QuotaExceeded {
+				reason = "Quota Exceeded"
+			}
+
 			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error":               "Rate Limit Exceeded",
+				"error":               reason,
 				"message":             result.Reason,
 				"retry_after_seconds": uint64(result.ResetTime.Sub(time.Now()).Seconds()),
 			})
 			c.Abort()
 			return
 		}
+
+		defer func() {
+			if err := result.Lease.Release(context.WithoutCancel(c.Request.Context())); err != nil {
+				fmt.Printf("failed to release concurrency slot: %v\n", err)
+			}
+		}()
+
+		if err := rateLimiter.Wait(c.Request.Context(), result); err != nil {
+			// 499 Client Closed Request: nobody is left to read the response.
+			c.AbortWithStatus(499)
+			return
+		}
+
 		c.Next()
+
+		// Handlers that only know the real cost after doing the work report it
+		// in the response; whatever exceeds the upfront cost is billed now.
+		if reported, err := strconv.Atoi(c.Writer.Header().Get(CostHeader)); err == nil && reported > cost {
+			if err := rateLimiter.Charge(context.WithoutCancel(c.Request.Context()), req, reported-cost); err != nil {
+				fmt.Printf("failed to charge request cost: %v\n", err)
+			}
+		}
+	}
+}
+
+// storageFailed handles a request whose limits could not be checked according
+// to the failure policy, reporting whether the request may still proceed.
+func storageFailed(c *gin.Context, rateLimiter *limiter.RateLimiter, err error) bool {
+	policy, retryAfter := rateLimiter.FailurePolicy()
+	if policy == limiter.FailurePolicyOpen {
+		fmt.Printf("rate limit check failed, letting request through: %v\n", err)
+		return true
+	}
+
+	c.Header("Retry-After", strconv.FormatInt(int64(retryAfter.Seconds()), 10))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":   err.Error(),
+		"message": "Service Unavailable",
+	})
+	c.Abort()
+	return false
+}
+
+// requestCost returns how many requests a call counts as: the cost configured
+// for its route, raised by a CostHeader on the request. Clients can declare a
+// higher cost but never go below the route's.
+func requestCost(c *gin.Context, rateLimiter *limiter.RateLimiter) int {
+	cost := rateLimiter.RouteCost(c.Request.Method, c.FullPath())
+	if declared, err := strconv.Atoi(c.GetHeader(CostHeader)); err == nil && declared > cost {
+		cost = declared
+	}
+	return cost
+}
+
+// clientRequest describes a request to the rate limiter.
+func clientRequest(c *gin.Context) limiter.Request {
+	clientIP, apiToken := ClientIdentity(c)
+	return limiter.Request{
+		IP:     clientIP,
+		Token:  apiToken,
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Route:  c.FullPath(),
+		Header: c.Request.Header,
+	}
+}
+
+// ClientIdentity returns the client IP and API token of a request. The token
+// is read from the API_KEY header or a bearer Authorization header.
+func ClientIdentity(c *gin.Context) (string, string) {
+	apiToken := c.GetHeader("API_KEY")
+	if apiToken == "" {
+		apiToken = c.GetHeader("Authorization")
+		if len(apiToken) > 7 && apiToken[:7] == "Bearer " {
+			apiToken = apiToken[7:]
+		}
 	}
+	return c.ClientIP(), apiToken
 }
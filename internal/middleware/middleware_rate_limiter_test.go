@@ -0,0 +1,124 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/config"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/limiter"
+	"github.com/jessicaamilena/go-rate-limiter-challenge/internal/middleware"
+)
+
+func newRouter(t *testing.T, policy *config.Policy) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	cfg := &config.Config{
+		IPLimit:             100,
+		IPWindow:            time.Minute,
+		IPBurst:             100,
+		IPAlgorithm:         limiter.AlgorithmFixedWindow,
+		BlockDuration:       time.Minute,
+		QuotaLocation:       time.UTC,
+		ConcurrencyLeaseTTL: time.Minute,
+		FailurePolicy:       limiter.FailurePolicyClosed,
+		Policy:              policy,
+	}
+	storage, err := limiter.NewMemoryStorage(1000, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rateLimiter := limiter.NewRateLimiter(cfg, storage)
+	t.Cleanup(func() { _ = rateLimiter.Close() })
+
+	router := gin.New()
+	router.Use(middleware.RateLimitMiddleware(rateLimiter))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/orders", ok)
+	router.POST("/orders", ok)
+	router.GET("/ping", ok)
+	return router
+}
+
+// TestRouteRules checks that rules matching different routes and methods
+// count requests apart from each other and from the client's usual limit,
+// and that each response names the rule it was checked against.
+func TestRouteRules(t *testing.T) {
+	router := newRouter(t, &config.Policy{Rules: []config.Rule{
+		{Name: "orders-write", Match: config.RuleMatch{Route: "/orders", Methods: []string{http.MethodPost}}, Limit: 2, Window: time.Minute},
+		{Name: "ping", Match: config.RuleMatch{Route: "/ping", Methods: []string{http.MethodGet}}, Limit: 3, Window: time.Minute},
+	}})
+
+	steps := []struct {
+		method, path string
+		wantStatus   int
+		wantRule     string
+		wantLimit    int
+		wantLeft     int
+	}{
+		{http.MethodPost, "/orders", http.StatusOK, "orders-write", 2, 1},
+		{http.MethodGet, "/ping", http.StatusOK, "ping", 3, 2},
+		{http.MethodPost, "/orders", http.StatusOK, "orders-write", 2, 0},
+		{http.MethodPost, "/orders", http.StatusTooManyRequests, "orders-write", 2, 0},
+		// The client is banned from writing orders only.
+		{http.MethodGet, "/ping", http.StatusOK, "ping", 3, 1},
+		{http.MethodGet, "/orders", http.StatusOK, "", 100, 99},
+		{http.MethodGet, "/ping", http.StatusOK, "ping", 3, 0},
+		{http.MethodGet, "/ping", http.StatusTooManyRequests, "ping", 3, 0},
+		{http.MethodGet, "/orders", http.StatusOK, "", 100, 98},
+		{http.MethodPost, "/orders", http.StatusTooManyRequests, "orders-write", 2, 0},
+	}
+
+	for i, step := range steps {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(step.method, step.path, nil)
+		router.ServeHTTP(w, req)
+
+		name := strconv.Itoa(i+1) + ": " + step.method + " " + step.path
+		if w.Code != step.wantStatus {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, step.wantStatus)
+		}
+		if rule := w.Header().Get("X-RateLimit-Rule"); rule != step.wantRule {
+			t.Errorf("%s: X-RateLimit-Rule = %q, want %q", name, rule, step.wantRule)
+		}
+		if limit := w.Header().Get("X-RateLimit-Limit"); limit != strconv.Itoa(step.wantLimit) {
+			t.Errorf("%s: X-RateLimit-Limit = %s, want %d", name, limit, step.wantLimit)
+		}
+		if left := w.Header().Get("X-RateLimit-Remaining"); left != strconv.Itoa(step.wantLeft) {
+			t.Errorf("%s: X-RateLimit-Remaining = %s, want %d", name, left, step.wantLeft)
+		}
+	}
+}
+
+// TestRouteRuleMethods checks that a rule restricted to some methods leaves
+// the other methods of its route to the client's usual limit.
+func TestRouteRuleMethods(t *testing.T) {
+	router := newRouter(t, &config.Policy{Rules: []config.Rule{
+		{Name: "orders-read", Match: config.RuleMatch{Route: "/orders", Methods: []string{http.MethodGet}}, Limit: 1, Window: time.Minute},
+		{Name: "orders-write", Match: config.RuleMatch{Route: "/orders", Methods: []string{http.MethodPost}}, Limit: 1, Window: time.Minute},
+	}})
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "/orders", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s /orders: status = %d, want %d", method, w.Code, http.StatusOK)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/orders", nil))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("X-RateLimit-Rule") != "orders-read" {
+		t.Errorf("GET /orders: status = %d with rule %q, want %d with orders-read", w.Code, w.Header().Get("X-RateLimit-Rule"), http.StatusTooManyRequests)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Rule") != "" {
+		t.Errorf("GET /ping: status = %d with rule %q, want %d without a rule", w.Code, w.Header().Get("X-RateLimit-Rule"), http.StatusOK)
+	}
+}